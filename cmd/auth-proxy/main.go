@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/habakke/auth-proxy/internal/access"
+	"github.com/habakke/auth-proxy/internal/assertion"
+	"github.com/habakke/auth-proxy/internal/auth"
 	"github.com/habakke/auth-proxy/internal/auth/providers"
+	"github.com/habakke/auth-proxy/internal/cookie"
 	"github.com/habakke/auth-proxy/internal/healthz"
 	"github.com/habakke/auth-proxy/internal/metrics"
+	"github.com/habakke/auth-proxy/internal/policy"
 	"github.com/habakke/auth-proxy/internal/session"
 	"github.com/habakke/auth-proxy/pkg/config"
 	"github.com/habakke/auth-proxy/pkg/helper"
@@ -70,15 +76,145 @@ func main() {
 
 	cookieSeed, err := helper.GetStringEnv("COOKIE_SEED")
 	helper.HandleError(err, true, "COOKIE_SEED environment variable not set")
-	cookieKey, err := helper.GetStringEnv("COOKIE_KEY")
-	helper.HandleError(err, true, "COOKIE_KEY environment variable not set")
+	cookieKeys := helper.GetStringListEnv("COOKIE_KEYS")
+	if cookieKeys == nil {
+		cookieKey, err := helper.GetStringEnv("COOKIE_KEY")
+		helper.HandleError(err, true, "COOKIE_KEY environment variable not set")
+		cookieKeys = []string{cookieKey}
+	}
 
-	oauthProvider := providers.New("Google", &providers.ProviderData{})
-	sm := session.NewManager(cookieSeed, cookieKey)
+	providerNames := helper.GetStringListEnv("PROVIDERS")
+	if providerNames == nil {
+		providerNames = []string{helper.GetStringEnvWithDefault("PROVIDER", "google")}
+	}
+	var oauthProviders []providers.Provider
+	for _, name := range providerNames {
+		oauthProviders = append(oauthProviders, providers.New(name, &providers.ProviderData{
+			AllowedEmails:  helper.GetStringListEnv("ALLOWED_EMAILS"),
+			AllowedDomains: helper.GetStringListEnv("ALLOWED_DOMAINS"),
+		}))
+	}
+
+	sm := session.NewManager(cookieSeed, cookieKeys[0])
+	helper.HandleError(sm.SetKeys(cookieKeys...), true, "invalid COOKIE_KEYS")
+	cookiePolicy := cookie.DefaultPolicy()
+	cookiePolicy.Domain = helper.GetStringEnvWithDefault("COOKIE_DOMAIN", "")
+	cookiePolicy.SameSite, err = cookie.ParseSameSite(helper.GetStringEnvWithDefault("COOKIE_SAMESITE", "lax"))
+	helper.HandleError(err, true, "invalid COOKIE_SAMESITE")
+	cookiePolicy.Secure = helper.GetBoolEnvWithDefault("COOKIE_SECURE", true)
+	cookiePolicy.Prefix = helper.GetStringEnvWithDefault("COOKIE_PREFIX", "")
+	cookiePolicy.Lifetime = helper.GetDurationEnvWithDefault("SESSION_LIFETIME", cookie.DefaultLifetime)
+	cookiePolicy.IdleTimeout = helper.GetDurationEnvWithDefault("SESSION_IDLE_TIMEOUT", cookie.DefaultIdleTimeout)
+	helper.HandleError(sm.SetPolicy(cookiePolicy), true, "invalid cookie policy")
+	switch storeType := helper.GetStringEnvWithDefault("SESSION_STORE", "cookie"); storeType {
+	case "cookie":
+	case "memory":
+		sm.SetStore(session.NewMemoryStore())
+	case "file":
+		storePath, err := helper.GetStringEnv("SESSION_STORE_PATH")
+		helper.HandleError(err, true, "SESSION_STORE_PATH environment variable not set")
+		store, err := session.NewBoltStore(storePath)
+		helper.HandleError(err, true, "failed to open SESSION_STORE_PATH")
+		defer store.Close()
+		sm.SetStore(store)
+	case "redis":
+		redisURL, err := helper.GetStringEnv("REDIS_URL")
+		helper.HandleError(err, true, "REDIS_URL environment variable not set")
+		store, err := session.NewRedisStore(redisURL)
+		helper.HandleError(err, true, "invalid REDIS_URL")
+		defer store.Close()
+		sm.SetStore(store)
+	default:
+		helper.HandleError(fmt.Errorf("unknown session store %q", storeType), true, "invalid SESSION_STORE")
+	}
 	p := proxy.NewProxy(
 		target,
-		oauthProvider,
+		oauthProviders,
 		sm)
+	if ldapURL, err := helper.GetStringEnv("LDAP_URL"); err == nil {
+		if helper.IsEnvSet("LOCAL_USERS_FILE") {
+			helper.HandleError(fmt.Errorf("LDAP_URL and LOCAL_USERS_FILE are both set"), true, "only one local login backend can be used")
+		}
+		ldapAuth, err := auth.NewLDAPAuth(ldapConfig(ldapURL))
+		helper.HandleError(err, true, "invalid LDAP configuration")
+		p.SetLocalAuth(ldapAuth)
+	} else if usersFile, err := helper.GetStringEnv("LOCAL_USERS_FILE"); err == nil {
+		localAuth := auth.NewAuthLocal()
+		helper.HandleError(localAuth.WatchFile(usersFile), true, "failed to load LOCAL_USERS_FILE")
+		defer localAuth.Close()
+		p.SetLocalAuth(localAuth)
+	}
+	// the second factor must not be dropped silently because TOTP_DB is missing from the environment
+	if helper.GetBoolEnvWithDefault("TOTP_ENABLED", helper.IsEnvSet("TOTP_DB")) {
+		totpDB, err := helper.GetStringEnv("TOTP_DB")
+		helper.HandleError(err, true, "TOTP_ENABLED requires TOTP_DB to keep the TOTP secrets in")
+		if _, err := os.Stat(totpDB); errors.Is(err, os.ErrNotExist) {
+			log.Warn().Str("path", totpDB).Msg("TOTP_DB does not exist, creating it, all users must enrol their second factor again")
+		}
+		store, err := auth.NewBoltTOTPStore(totpDB)
+		helper.HandleError(err, true, "failed to open TOTP_DB")
+		defer store.Close()
+		p.SetTOTP(auth.NewTOTP(store, helper.GetStringEnvWithDefault("TOTP_ISSUER", "auth-proxy")))
+	}
+	if passkeyDB, err := helper.GetStringEnv("PASSKEY_DB"); err == nil {
+		rpID, err := helper.GetStringEnv("WEBAUTHN_RP_ID")
+		helper.HandleError(err, true, "WEBAUTHN_RP_ID environment variable not set")
+		store, err := auth.NewBoltPasskeyStore(passkeyDB)
+		helper.HandleError(err, true, "failed to open PASSKEY_DB")
+		defer store.Close()
+		passkeys, err := auth.NewPasskeys(rpID, helper.GetStringEnvWithDefault("WEBAUTHN_RP_NAME", "auth-proxy"), helper.GetStringListEnv("WEBAUTHN_RP_ORIGINS"), store)
+		helper.HandleError(err, true, "invalid WebAuthn configuration")
+		p.SetPasskeys(passkeys)
+	}
+	p.SetAllowedRedirectHosts(helper.GetStringListEnv("REDIRECT_ALLOWED_HOSTS"))
+	p.SetVerifyRedirect(helper.GetBoolEnvWithDefault("VERIFY_REDIRECT", false))
+
+	if accessDB, err := helper.GetStringEnv("ACCESS_DB"); err == nil {
+		store, err := access.NewBoltStore(accessDB)
+		helper.HandleError(err, true, "failed to open ACCESS_DB")
+		defer store.Close()
+		p.SetAccessStore(store)
+	}
+	adminGroups := helper.GetStringListEnv("ADMIN_GROUPS")
+	p.SetAdmins(helper.GetStringListEnv("ADMIN_EMAILS"), adminGroups)
+
+	groups := adminGroups
+	if policyFile, err := helper.GetStringEnv("POLICY_FILE"); err == nil {
+		rules, err := policy.Load(policyFile)
+		helper.HandleError(err, true, "failed to load POLICY_FILE")
+		p.SetPolicy(rules)
+		groups = append(groups, rules.Groups()...)
+	}
+	// anyone can create a group at one provider named like a group at another, so groups must name their provider
+	// when several providers issue groups
+	groupProviders := len(oauthProviders)
+	if helper.IsEnvSet("LDAP_URL") {
+		groupProviders++
+	}
+	if groupProviders > 1 {
+		for _, g := range groups {
+			if !session.QualifiedGroup(g) {
+				helper.HandleError(fmt.Errorf("group %q does not name its provider, ex. github:%s", g, g), true, "ambiguous group in ADMIN_GROUPS or POLICY_FILE")
+			}
+		}
+	}
+
+	identityHeaders := proxy.DefaultIdentityHeaders()
+	identityHeaders.User = helper.GetStringEnvWithDefault("IDENTITY_HEADER_USER", identityHeaders.User)
+	identityHeaders.Email = helper.GetStringEnvWithDefault("IDENTITY_HEADER_EMAIL", identityHeaders.Email)
+	identityHeaders.Name = helper.GetStringEnvWithDefault("IDENTITY_HEADER_NAME", identityHeaders.Name)
+	identityHeaders.Groups = helper.GetStringEnvWithDefault("IDENTITY_HEADER_GROUPS", identityHeaders.Groups)
+	identityHeaders.Provider = helper.GetStringEnvWithDefault("IDENTITY_HEADER_PROVIDER", identityHeaders.Provider)
+	p.SetIdentityHeaders(identityHeaders)
+
+	if keyPath, err := helper.GetStringEnv("JWT_SIGNING_KEY"); err == nil {
+		signer, err := assertion.LoadSigner(keyPath)
+		helper.HandleError(err, true, "failed to load JWT_SIGNING_KEY")
+		signer.Issuer = helper.GetStringEnvWithDefault("JWT_ISSUER", "")
+		signer.Audience = helper.GetStringListEnv("JWT_AUDIENCE")
+		signer.TTL = time.Duration(helper.GetIntEnvWithDefault("JWT_TTL", int(assertion.DefaultTTL.Seconds()))) * time.Second
+		p.SetIdentityAssertion(signer, helper.GetStringEnvWithDefault("JWT_HEADER", proxy.DefaultAssertionHeader))
+	}
 
 	token, err := helper.GetStringEnv("TOKEN")
 	helper.HandleError(err, true, "TOKEN environment variable not set")
@@ -120,3 +256,31 @@ func waitForSignal() os.Signal {
 	signal.Stop(signalChan)
 	return s
 }
+
+// ldapConfig reads the configuration of the LDAP backend of the login form from the environment
+func ldapConfig(url string) auth.LDAPConfig {
+	config := auth.DefaultLDAPConfig()
+	config.URL = url
+	config.StartTLS = helper.GetBoolEnvWithDefault("LDAP_START_TLS", false)
+	config.InsecureSkipVerify = helper.GetBoolEnvWithDefault("LDAP_INSECURE_SKIP_VERIFY", false)
+	if caFile, err := helper.GetStringEnv("LDAP_CA_FILE"); err == nil {
+		config.RootCAs, err = auth.ReadCACertFile(caFile)
+		helper.HandleError(err, true, "failed to read LDAP_CA_FILE")
+	}
+	config.BindDN = helper.GetStringEnvWithDefault("LDAP_BIND_DN", "")
+	config.BindPassword = helper.GetStringEnvWithDefault("LDAP_BIND_PASSWORD", "")
+	config.UserBaseDN = helper.GetStringEnvWithDefault("LDAP_USER_BASE_DN", "")
+	config.UserFilter = helper.GetStringEnvWithDefault("LDAP_USER_FILTER", config.UserFilter)
+	config.UsernameAttribute = helper.GetStringEnvWithDefault("LDAP_USERNAME_ATTRIBUTE", config.UsernameAttribute)
+	config.LookupFilter = helper.GetStringEnvWithDefault("LDAP_LOOKUP_FILTER", "")
+	config.EmailAttribute = helper.GetStringEnvWithDefault("LDAP_EMAIL_ATTRIBUTE", config.EmailAttribute)
+	config.NameAttribute = helper.GetStringEnvWithDefault("LDAP_NAME_ATTRIBUTE", config.NameAttribute)
+	config.GroupAttribute = helper.GetStringEnvWithDefault("LDAP_GROUP_ATTRIBUTE", config.GroupAttribute)
+	config.GroupBaseDN = helper.GetStringEnvWithDefault("LDAP_GROUP_BASE_DN", "")
+	config.GroupFilter = helper.GetStringEnvWithDefault("LDAP_GROUP_FILTER", config.GroupFilter)
+	config.GroupNameAttribute = helper.GetStringEnvWithDefault("LDAP_GROUP_NAME_ATTRIBUTE", config.GroupNameAttribute)
+	config.GroupNames = helper.GetStringEnvWithDefault("LDAP_GROUP_NAMES", config.GroupNames)
+	config.Timeout = helper.GetDurationEnvWithDefault("LDAP_TIMEOUT", config.Timeout)
+	config.LookupTTL = helper.GetDurationEnvWithDefault("LDAP_LOOKUP_TTL", config.LookupTTL)
+	return config
+}
@@ -0,0 +1,56 @@
+package access
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	// Pending requests are waiting for an admin to approve or deny them
+	Pending Status = "pending"
+	// Approved users are allowed to reach the upstream
+	Approved Status = "approved"
+	// Denied users are not allowed to reach the upstream
+	Denied Status = "denied"
+)
+
+var ErrNotFound = errors.New("access request not found")
+
+// Request is the request of a user for access to the upstream
+type Request struct {
+	ID          string    `json:"id"`
+	Provider    string    `json:"provider"`
+	UserID      string    `json:"user_id"`
+	Email       string    `json:"email,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Status      Status    `json:"status"`
+	RequestedAt time.Time `json:"requested_at"`
+	DecidedAt   time.Time `json:"decided_at"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+}
+
+// Store keeps the access requests and the decisions made on them
+type Store interface {
+	// Get returns the request with the ID, or ErrNotFound
+	Get(id string) (*Request, error)
+	// Request stores a pending request unless the user has already requested access, and returns the stored request
+	Request(r Request) (*Request, error)
+	// Decide sets the status of the request, recording the admin deciding it
+	Decide(id string, status Status, decidedBy string) (*Request, error)
+	// List returns all requests, oldest first
+	List() ([]Request, error)
+	Close() error
+}
+
+// RequestID returns the ID of the access request of a user at a provider
+func RequestID(provider string, userID string) string {
+	return strings.ToLower(provider) + ":" + userID
+}
+
+// ValidStatus returns true if the status can be set by an admin
+func ValidStatus(status Status) bool {
+	return status == Pending || status == Approved || status == Denied
+}
@@ -0,0 +1,122 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+var requestsBucket = []byte("requests")
+
+// BoltStore keeps the access requests in a local BoltDB file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access database: %s", err.Error())
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(requestsBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize access database: %s", err.Error())
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func get(b *bolt.Bucket, id string) (*Request, error) {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	r := &Request{}
+	if err := json.Unmarshal(v, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func put(b *bolt.Bucket, r *Request) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(r.ID), v)
+}
+
+func (s *BoltStore) Get(id string) (*Request, error) {
+	var r *Request
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = get(tx.Bucket(requestsBucket), id)
+		return err
+	})
+	return r, err
+}
+
+func (s *BoltStore) Request(r Request) (*Request, error) {
+	var stored *Request
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		var err error
+		if stored, err = get(b, r.ID); err != ErrNotFound {
+			return err
+		}
+
+		r.Status = Pending
+		r.RequestedAt = time.Now().UTC()
+		stored = &r
+		return put(b, stored)
+	})
+	return stored, err
+}
+
+func (s *BoltStore) Decide(id string, status Status, decidedBy string) (*Request, error) {
+	if !ValidStatus(status) {
+		return nil, fmt.Errorf("invalid status %q", status)
+	}
+
+	var r *Request
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		var err error
+		if r, err = get(b, id); err != nil {
+			return err
+		}
+
+		r.Status = status
+		r.DecidedAt = time.Now().UTC()
+		r.DecidedBy = decidedBy
+		return put(b, r)
+	})
+	return r, err
+}
+
+func (s *BoltStore) List() ([]Request, error) {
+	var requests []Request
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).ForEach(func(k, v []byte) error {
+			r := Request{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			requests = append(requests, r)
+			return nil
+		})
+	})
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].RequestedAt.Before(requests[j].RequestedAt)
+	})
+	return requests, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
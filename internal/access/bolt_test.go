@@ -0,0 +1,49 @@
+package access
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.db")
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+
+	_, err = s.Get(RequestID("Google", "1"))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	r, err := s.Request(Request{ID: RequestID("Google", "1"), Provider: "Google", UserID: "1", Email: "one@example.com"})
+	require.NoError(t, err)
+	require.Equal(t, Pending, r.Status)
+	require.Equal(t, "google:1", r.ID)
+	_, err = s.Request(Request{ID: RequestID("GitHub", "2"), Provider: "GitHub", UserID: "2"})
+	require.NoError(t, err)
+
+	// Decisions are kept when the user requests access again
+	r, err = s.Decide(RequestID("Google", "1"), Approved, "admin@example.com")
+	require.NoError(t, err)
+	require.Equal(t, Approved, r.Status)
+	r, err = s.Request(Request{ID: RequestID("Google", "1"), Provider: "Google", UserID: "1"})
+	require.NoError(t, err)
+	require.Equal(t, Approved, r.Status)
+	require.Equal(t, "admin@example.com", r.DecidedBy)
+
+	_, err = s.Decide(RequestID("Google", "1"), "maybe", "admin@example.com")
+	require.Error(t, err)
+	_, err = s.Decide(RequestID("Google", "3"), Denied, "admin@example.com")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Requests are persisted
+	require.NoError(t, s.Close())
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+	requests, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	require.Equal(t, "google:1", requests[0].ID)
+	require.Equal(t, Approved, requests[0].Status)
+	require.Equal(t, Pending, requests[1].Status)
+}
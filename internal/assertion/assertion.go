@@ -0,0 +1,138 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"os"
+	"time"
+)
+
+// DefaultTTL is how long an assertion is valid by default. Assertions are minted for each upstream request,
+// so they only have to outlive the request.
+const DefaultTTL = time.Minute
+
+// Claims are the claims of the assertion
+type Claims struct {
+	jwt.Claims
+	Email    string   `json:"email,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+}
+
+// Signer mints signed JWTs asserting the identity of a session to the upstream
+type Signer struct {
+	Issuer   string
+	Audience []string
+	TTL      time.Duration
+
+	key    jose.JSONWebKey
+	signer jose.Signer
+}
+
+// LoadSigner returns a signer for the PEM encoded RSA or ECDSA private key in the file
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %s", err.Error())
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %s", err.Error())
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return NewSigner(signer)
+}
+
+// NewSigner returns a signer using RS256 for RSA keys, and ES256, ES384 or ES512 for ECDSA keys
+func NewSigner(key crypto.Signer) (*Signer, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	jwk := jose.JSONWebKey{Key: key, Algorithm: string(alg), Use: "sig"}
+	public := jwk.Public()
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: jwk}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{
+		TTL:    DefaultTTL,
+		key:    jwk,
+		signer: signer,
+	}, nil
+}
+
+// Sign returns a JWT asserting the identity of the session
+func (s *Signer) Sign(data *session.Data) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Claims: jwt.Claims{
+			Issuer:    s.Issuer,
+			Subject:   data.ID,
+			Audience:  s.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(s.TTL)),
+		},
+		Email:    data.Email,
+		Name:     data.Name,
+		Groups:   data.Groups,
+		Provider: data.Provider,
+	}
+
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+// JWKS returns the key set the upstream verifies the assertions with
+func (s *Signer) JWKS() jose.JSONWebKeySet {
+	return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{s.key.Public()}}
+}
@@ -0,0 +1,89 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name string
+		path string
+		alg  string
+	}{
+		{name: "pkcs1", path: writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), alg: "RS256"},
+		{name: "pkcs8", path: writeKey(t, "PRIVATE KEY", pkcs8), alg: "ES256"},
+		{name: "sec1", path: writeKey(t, "EC PRIVATE KEY", sec1), alg: "ES256"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := LoadSigner(tt.path)
+			require.NoError(t, err)
+			s.Issuer = "https://auth.example.com"
+			s.Audience = []string{"app"}
+
+			raw, err := s.Sign(&session.Data{ID: "test", Email: "test@example.com", Groups: []string{"a"}, Provider: "Google"})
+			require.NoError(t, err)
+
+			token, err := jwt.ParseSigned(raw)
+			require.NoError(t, err)
+			require.Equal(t, tt.alg, token.Headers[0].Algorithm)
+
+			keys := s.JWKS()
+			require.Len(t, keys.Keys, 1)
+			require.True(t, keys.Keys[0].IsPublic())
+			jwks := keys.Key(token.Headers[0].KeyID)
+			require.Len(t, jwks, 1)
+
+			claims := Claims{}
+			require.NoError(t, token.Claims(jwks[0].Key, &claims))
+			require.NoError(t, claims.Validate(jwt.Expected{Issuer: "https://auth.example.com", Audience: jwt.Audience{"app"}, Time: time.Now()}))
+			require.Equal(t, "test", claims.Subject)
+			require.Equal(t, "test@example.com", claims.Email)
+			require.Equal(t, []string{"a"}, claims.Groups)
+			require.Equal(t, "Google", claims.Provider)
+
+			// Assertions are short-lived
+			require.Error(t, claims.Validate(jwt.Expected{Time: time.Now().Add(DefaultTTL + 2*time.Minute)}))
+		})
+	}
+}
+
+func TestUnsupportedKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(t, err)
+	_, err = NewSigner(ecKey)
+	require.Error(t, err)
+
+	_, err = NewSigner(crypto.Signer(nil))
+	require.Error(t, err)
+
+	_, err = LoadSigner(writeKey(t, "PRIVATE KEY", []byte("garbage")))
+	require.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadHtpasswd reads the users of an htpasswd file with bcrypt (htpasswd -B) or argon2id hashes. Empty lines and
+// lines starting with # are ignored.
+func ReadHtpasswd(path string) (map[string]*LocalUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %s", err.Error())
+	}
+	defer f.Close()
+
+	users := map[string]*LocalUser{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid htpasswd line %d", n)
+		}
+		if err := validateHash(hash); err != nil {
+			return nil, fmt.Errorf("invalid password hash of %s on line %d: %s", username, n, err.Error())
+		}
+		users[username] = &LocalUser{Username: username, PasswordHash: hash}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %s", err.Error())
+	}
+	return users, nil
+}
+
+// LoadFile replaces the users with the users of the htpasswd file
+func (a *LocalAuth) LoadFile(path string) error {
+	users, err := ReadHtpasswd(path)
+	if err != nil {
+		return err
+	}
+	a.setUsers(users)
+	return nil
+}
+
+// fileWatcher reloads a file when it changes
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// WatchFile loads the htpasswd file, and reloads it whenever it changes until Close is called. The directory of the
+// file is watched, so files replaced by renaming, as editors and Kubernetes secret volumes do, are reloaded too.
+// The users are kept if the changed file can not be read.
+func (a *LocalAuth) WatchFile(path string) error {
+	if err := a.LoadFile(path); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch htpasswd file: %s", err.Error())
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("failed to watch htpasswd file: %s", err.Error())
+	}
+
+	w := &fileWatcher{watcher: watcher, done: make(chan struct{})}
+	a.mu.Lock()
+	a.watcher = w
+	a.mu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				if _, err := os.Stat(path); err != nil {
+					continue
+				}
+				if err := a.LoadFile(path); err != nil {
+					log.Error().AnErr("err", err).Str("path", path).Msg("failed to reload htpasswd file")
+					continue
+				}
+				log.Info().Str("path", path).Msg("reloaded htpasswd file")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().AnErr("err", err).Str("path", path).Msg("failed to watch htpasswd file")
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the htpasswd file
+func (a *LocalAuth) Close() error {
+	a.mu.Lock()
+	w := a.watcher
+	a.watcher = nil
+	a.mu.Unlock()
+
+	if w == nil {
+		return nil
+	}
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
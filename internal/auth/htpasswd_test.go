@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	p := &argon2idParams{memory: 1024, iterations: 1, parallelism: 1, salt: []byte("0123456789abcdef"), hash: make([]byte, 32)}
+	p.hash = p.derive(password)
+	return p.String()
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# local users\nalice:%s\n\nbob:%s\n", bcryptHash(t, "alice-secret"), argon2idHash("bob-secret"))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	a := NewAuthLocal()
+	require.NoError(t, a.LoadFile(path))
+
+	u, ok := a.Authenticate("alice", "alice-secret")
+	require.True(t, ok)
+	require.Equal(t, "alice", u.GetID())
+	_, ok = a.Authenticate("alice", "bob-secret")
+	require.False(t, ok)
+	_, ok = a.Authenticate("bob", "bob-secret")
+	require.True(t, ok)
+	_, ok = a.Authenticate("bob", "alice-secret")
+	require.False(t, ok)
+	_, ok = a.Authenticate("carol", "alice-secret")
+	require.False(t, ok)
+	_, ok = a.Authenticate("carol", "")
+	require.False(t, ok)
+
+	// Only bcrypt and argon2id hashes are accepted
+	for _, line := range []string{"carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "carol:$apr1$abc$def", "carol:plaintext", "carol", ":" + bcryptHash(t, "x")} {
+		require.NoError(t, os.WriteFile(path, []byte(line+"\n"), 0600))
+		require.Error(t, a.LoadFile(path), line)
+	}
+	_, ok = a.Authenticate("alice", "alice-secret")
+	require.True(t, ok)
+
+	require.Error(t, a.LoadFile(filepath.Join(t.TempDir(), "missing")))
+}
+
+func TestDummyHash(t *testing.T) {
+	// Unknown users are checked against a hash as costly as the hashes of known users
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), 6)
+	require.NoError(t, err)
+	dummy := dummyHash(string(hash))
+	cost, err := bcrypt.Cost([]byte(dummy))
+	require.NoError(t, err)
+	require.Equal(t, 6, cost)
+
+	p, err := parseArgon2id(dummyHash(argon2idHash("secret")))
+	require.NoError(t, err)
+	require.Equal(t, uint32(1024), p.memory)
+	require.Equal(t, uint32(1), p.iterations)
+	require.Len(t, p.hash, 32)
+
+	a := NewAuthLocal()
+	a.AddUser(&LocalUser{Username: "alice", PasswordHash: string(hash)})
+	cost, err = bcrypt.Cost([]byte(a.dummy.hash))
+	require.NoError(t, err)
+	require.Equal(t, 6, cost)
+
+	// With mixed parameters the dummy has the slowest ones, whichever user comes first
+	slow, err := bcrypt.GenerateFromPassword([]byte("secret"), 11)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		a.setUsers(map[string]*LocalUser{
+			"alice": {Username: "alice", PasswordHash: string(hash)},
+			"bob":   {Username: "bob", PasswordHash: argon2idHash("secret")},
+			"carol": {Username: "carol", PasswordHash: string(slow)},
+		})
+		cost, err = bcrypt.Cost([]byte(a.dummy.hash))
+		require.NoError(t, err)
+		require.Equal(t, 11, cost)
+	}
+
+	// Known users with cheaper hashes take as long as the dummy
+	start := time.Now()
+	_, ok := a.Authenticate("alice", "secret")
+	require.True(t, ok)
+	require.GreaterOrEqual(t, time.Since(start), a.dummy.took)
+}
+
+func TestArgon2idParameters(t *testing.T) {
+	salt := "MDEyMzQ1Njc4OWFiY2RlZg"
+	hash := "c2VjcmV0IGhhc2ggb2YgMzIgYnl0ZXMgbG9uZyEhIQ"
+	_, err := parseArgon2id("$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + hash)
+	require.NoError(t, err)
+
+	// Parameters argon2 panics on are rejected when the file is loaded, instead of at login
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + hash,
+		"$argon2id$v=19$m=7,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=16,t=1,p=4$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=1$MDEy$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$c2Vj",
+		// parameters making every login allocate or compute without bounds are rejected too
+		"$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1000,p=1$" + salt + "$" + hash,
+		"$argon2id$v=19$m=1024,t=1,p=255$" + salt + "$" + hash,
+		"$2b$31$0123456789012345678901uNBVBvyyyrZ3Gb5p8z8ZAyz4ohK8wX6",
+	} {
+		require.Error(t, validateHash(encoded), encoded)
+	}
+}
+
+func TestWatchHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte("alice:"+bcryptHash(t, "alice-secret")+"\n"), 0600))
+
+	a := NewAuthLocal()
+	require.NoError(t, a.WatchFile(path))
+	defer a.Close()
+
+	// Files replaced by renaming are reloaded
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("bob:"+bcryptHash(t, "bob-secret")+"\n"), 0600))
+	require.NoError(t, os.Rename(tmp, path))
+	require.Eventually(t, func() bool {
+		_, ok := a.Authenticate("bob", "bob-secret")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok := a.Authenticate("alice", "alice-secret")
+	require.False(t, ok)
+
+	// Invalid files keep the users
+	require.NoError(t, os.WriteFile(path, []byte("carol:plaintext\n"), 0600))
+	time.Sleep(100 * time.Millisecond)
+	_, ok = a.Authenticate("bob", "bob-secret")
+	require.True(t, ok)
+
+	require.NoError(t, a.Close())
+	require.NoError(t, a.Close())
+}
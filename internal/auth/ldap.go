@@ -0,0 +1,453 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/habakke/auth-proxy/internal/auth/providers"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAPProviderName is recorded in sessions created by LDAP authentication
+const LDAPProviderName = "ldap"
+
+const (
+	DefaultLDAPUserFilter  = "(uid={username})"
+	DefaultLDAPGroupFilter = "(member={dn})"
+	DefaultLDAPTimeout     = 10 * time.Second
+	DefaultLDAPLookupTTL   = time.Minute
+)
+
+const (
+	// LDAPGroupNamesDN names groups by their full DN, which is unique in the directory
+	LDAPGroupNamesDN = "dn"
+	// LDAPGroupNamesShort names groups by their name attribute, or the first RDN value of the DNs in memberOf, which
+	// is the same for groups of the same name in different parts of the directory
+	LDAPGroupNamesShort = "name"
+)
+
+// LDAPConfig configures how users are looked up and authenticated in the directory
+type LDAPConfig struct {
+	// URL of the directory, ldap:// or ldaps://
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// RootCAs verifies the certificate of the directory. The system roots are used if nil.
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+
+	// BindDN and BindPassword of the service account searching for users. The search is anonymous without a BindDN.
+	BindDN       string
+	BindPassword string
+
+	UserBaseDN string
+	// UserFilter finds the user, with {username} replaced by the escaped username, such as
+	// (sAMAccountName={username}) for Active Directory
+	UserFilter string
+	// UsernameAttribute of the user holding the username as stored in the directory, such as sAMAccountName for
+	// Active Directory. It is the ID of the user, so logins typing the username in another case get the same ID.
+	// Users without it are rejected.
+	UsernameAttribute string
+	// LookupFilter finds users of existing sessions, with {username} replaced by the escaped ID. It defaults to the
+	// UserFilter and the UsernameAttribute both matching the ID.
+	LookupFilter   string
+	EmailAttribute string
+	NameAttribute  string
+	// GroupAttribute of the user listing the DNs of its groups, read unless GroupBaseDN is set
+	GroupAttribute string
+
+	// GroupBaseDN enables searching for the groups of the user, for directories without memberOf
+	GroupBaseDN string
+	// GroupFilter finds the groups of the user, with {dn} replaced by the escaped DN and {username} by the
+	// escaped username
+	GroupFilter        string
+	GroupNameAttribute string
+	// GroupNames is LDAPGroupNamesDN or LDAPGroupNamesShort
+	GroupNames string
+
+	Timeout time.Duration
+	// LookupTTL is how long users looked up for existing sessions are cached, which is how long it takes before
+	// users removed from the directory are signed out
+	LookupTTL time.Duration
+}
+
+// DefaultLDAPConfig returns the defaults for an OpenLDAP or Active Directory with the memberOf overlay
+func DefaultLDAPConfig() LDAPConfig {
+	return LDAPConfig{
+		UserFilter:         DefaultLDAPUserFilter,
+		UsernameAttribute:  "uid",
+		EmailAttribute:     "mail",
+		NameAttribute:      "displayName",
+		GroupAttribute:     "memberOf",
+		GroupFilter:        DefaultLDAPGroupFilter,
+		GroupNameAttribute: "cn",
+		GroupNames:         LDAPGroupNamesDN,
+		Timeout:            DefaultLDAPTimeout,
+		LookupTTL:          DefaultLDAPLookupTTL,
+	}
+}
+
+// ReadCACertFile reads PEM encoded certificates into a pool, for LDAPConfig.RootCAs
+func ReadCACertFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+type LDAPUser struct {
+	DN       string
+	Username string
+	Email    string
+	Name     string
+	Groups   []string
+}
+
+func (u LDAPUser) GetID() string {
+	return u.Username
+}
+
+func (u LDAPUser) GetUsername() string {
+	return u.Username
+}
+
+func (u LDAPUser) GetName() string {
+	return u.Name
+}
+
+func (u LDAPUser) GetEmail() string {
+	return u.Email
+}
+
+func (u LDAPUser) GetEmailVerified() bool {
+	return false
+}
+
+func (u LDAPUser) GetGroups() []string {
+	return u.Groups
+}
+
+// LDAPAuth authenticates users of the login form against a directory, by searching for the user and binding as it
+type LDAPAuth struct {
+	config    LDAPConfig
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	lookups map[string]ldapLookup
+}
+
+// ldapLookup is a cached lookup of a user, which is nil if the user was not found
+type ldapLookup struct {
+	user    *LDAPUser
+	expires time.Time
+}
+
+func NewLDAPAuth(config LDAPConfig) (*LDAPAuth, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ldap":
+	case "ldaps":
+		if config.StartTLS {
+			return nil, fmt.Errorf("StartTLS can not be used with ldaps://")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in LDAP URL, expected ldap:// or ldaps://", u.Scheme)
+	}
+	if config.UserBaseDN == "" {
+		return nil, fmt.Errorf("no LDAP user base DN")
+	}
+	if !strings.Contains(config.UserFilter, "{username}") {
+		return nil, fmt.Errorf("LDAP user filter %q has no {username}", config.UserFilter)
+	}
+	if config.LookupFilter == "" {
+		config.LookupFilter = fmt.Sprintf("(&%s(%s={username}))", config.UserFilter, config.UsernameAttribute)
+	}
+	if !strings.Contains(config.LookupFilter, "{username}") {
+		return nil, fmt.Errorf("LDAP lookup filter %q has no {username}", config.LookupFilter)
+	}
+	if config.GroupBaseDN != "" && config.GroupFilter == "" {
+		return nil, fmt.Errorf("no LDAP group filter")
+	}
+	switch config.GroupNames {
+	case LDAPGroupNamesDN, LDAPGroupNamesShort:
+	case "":
+		config.GroupNames = LDAPGroupNamesDN
+	default:
+		return nil, fmt.Errorf("unsupported LDAP group names %q, expected %s or %s", config.GroupNames, LDAPGroupNamesDN, LDAPGroupNamesShort)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultLDAPTimeout
+	}
+	if config.LookupTTL <= 0 {
+		config.LookupTTL = DefaultLDAPLookupTTL
+	}
+
+	return &LDAPAuth{
+		config:  config,
+		lookups: make(map[string]ldapLookup),
+		tlsConfig: &tls.Config{
+			ServerName:         u.Hostname(),
+			RootCAs:            config.RootCAs,
+			InsecureSkipVerify: config.InsecureSkipVerify, //#nosec
+			MinVersion:         tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// Name returns the provider recorded in the sessions of the users
+func (a *LDAPAuth) Name() string {
+	return LDAPProviderName
+}
+
+// Authenticate searches for the user with the service account, and checks the password by binding as the user
+func (a *LDAPAuth) Authenticate(username string, password string) (providers.User, bool) {
+	// an empty password is an anonymous bind, which most directories accept
+	if username == "" || password == "" {
+		return nil, false
+	}
+
+	user, err := a.authenticate(username, password)
+	if err != nil {
+		log.Error().AnErr("err", err).Str("username", username).Msg("ldap authentication failed")
+		return nil, false
+	}
+	if user == nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// Lookup searches for the user with the ID with the service account, without checking the password. Users are cached
+// for the lookup TTL, so the directory is not searched on every request of existing sessions. Users are not found
+// while the directory can not be reached.
+func (a *LDAPAuth) Lookup(id string) (providers.User, bool) {
+	now := time.Now()
+	a.mu.Lock()
+	cached, ok := a.lookups[id]
+	a.mu.Unlock()
+	if !ok || now.After(cached.expires) {
+		user, err := a.lookup(id)
+		if err != nil {
+			log.Error().AnErr("err", err).Str("username", id).Msg("ldap lookup failed")
+			return nil, false
+		}
+		cached = ldapLookup{user: user, expires: now.Add(a.config.LookupTTL)}
+
+		a.mu.Lock()
+		for key, l := range a.lookups {
+			if now.After(l.expires) {
+				delete(a.lookups, key)
+			}
+		}
+		a.lookups[id] = cached
+		a.mu.Unlock()
+	}
+
+	if cached.user == nil {
+		return nil, false
+	}
+	return cached.user, true
+}
+
+// lookup returns nil without an error if the user is not found, or no longer has the ID
+func (a *LDAPAuth) lookup(id string) (*LDAPUser, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+	entry, err := a.findUser(conn, a.config.LookupFilter, id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	// the filter may match other attributes than the ID, such as the email address of another user
+	if entry.GetEqualFoldAttributeValue(a.config.UsernameAttribute) != id {
+		log.Info().Str("id", id).Str("dn", entry.DN).Msg("ldap lookup found a user with another ID")
+		return nil, nil
+	}
+	return a.user(conn, entry)
+}
+
+// authenticate returns nil without an error if the user is not found or the password is wrong
+func (a *LDAPAuth) authenticate(username string, password string) (*LDAPUser, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	entry, err := a.findUser(conn, a.config.UserFilter, username)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.GetEqualFoldAttributeValue(a.config.UsernameAttribute) == "" {
+		log.Warn().Str("dn", entry.DN).Str("attribute", a.config.UsernameAttribute).Msg("ldap user has no username attribute")
+		return nil, nil
+	}
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to bind as %s: %w", entry.DN, err)
+	}
+
+	// the user may not be allowed to read the groups
+	if a.config.GroupBaseDN != "" {
+		if err = a.bindServiceAccount(conn); err != nil {
+			return nil, err
+		}
+	}
+	return a.user(conn, entry)
+}
+
+// user reads the user from the entry, and searches for its groups if GroupBaseDN is set
+func (a *LDAPAuth) user(conn *ldap.Conn, entry *ldap.Entry) (*LDAPUser, error) {
+	user := &LDAPUser{
+		DN:       entry.DN,
+		Username: entry.GetEqualFoldAttributeValue(a.config.UsernameAttribute),
+		Email:    entry.GetEqualFoldAttributeValue(a.config.EmailAttribute),
+		Name:     entry.GetEqualFoldAttributeValue(a.config.NameAttribute),
+	}
+
+	if a.config.GroupBaseDN == "" {
+		for _, dn := range entry.GetEqualFoldAttributeValues(a.config.GroupAttribute) {
+			if name := a.groupName(dn, ""); name != "" {
+				user.Groups = append(user.Groups, name)
+			}
+		}
+		return user, nil
+	}
+
+	var err error
+	if user.Groups, err = a.findGroups(conn, entry.DN, user.Username); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (a *LDAPAuth) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", a.config.URL, err)
+	}
+	conn.SetTimeout(a.config.Timeout)
+
+	if a.config.StartTLS {
+		if err = conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuth) bindServiceAccount(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+		return fmt.Errorf("failed to bind as %s: %w", a.config.BindDN, err)
+	}
+	return nil
+}
+
+// findUser returns the entry of the user matching the filter, or nil if there is not exactly one
+func (a *LDAPAuth) findUser(conn *ldap.Conn, filter string, username string) (*ldap.Entry, error) {
+	filter = strings.ReplaceAll(filter, "{username}", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.config.Timeout.Seconds()), false,
+		filter,
+		[]string{a.config.UsernameAttribute, a.config.EmailAttribute, a.config.NameAttribute, a.config.GroupAttribute},
+		nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			log.Warn().Str("username", username).Msg("ldap user filter matches several users")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to search for user: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		if len(res.Entries) > 1 {
+			log.Warn().Str("username", username).Msg("ldap user filter matches several users")
+		}
+		return nil, nil
+	}
+	return res.Entries[0], nil
+}
+
+// findGroups returns the names of the groups the user is a member of
+func (a *LDAPAuth) findGroups(conn *ldap.Conn, dn string, username string) ([]string, error) {
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(dn),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(a.config.GroupFilter)
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.config.Timeout.Seconds()), false,
+		filter,
+		[]string{a.config.GroupNameAttribute},
+		nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to search for groups: %w", err)
+	}
+
+	var groups []string
+	for _, e := range res.Entries {
+		if name := a.groupName(e.DN, e.GetEqualFoldAttributeValue(a.config.GroupNameAttribute)); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// groupName returns the DN of the group, or with short group names the name read from the group, falling back to the
+// first RDN value of the DN
+func (a *LDAPAuth) groupName(dn string, name string) string {
+	if a.config.GroupNames == LDAPGroupNamesDN {
+		return dn
+	}
+	if name != "" {
+		return name
+	}
+	return rdnValue(dn)
+}
+
+// rdnValue returns the value of the first RDN of the DN, which is the name of the group for cn=admins,ou=groups
+func rdnValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func startDirectory(t *testing.T, opts ...testdirectory.Option) *testdirectory.Directory {
+	users := testdirectory.NewUsers(t, []string{"alice"},
+		testdirectory.WithMembersOf(t, testdirectory.NewMemberOf(t, []string{"admins", "developers"})...))
+	// carol is in a group named like the one of alice elsewhere in the directory
+	users = append(users, testdirectory.NewUsers(t, []string{"carol"},
+		testdirectory.WithMembersOf(t, "cn=admins,ou=contractors,dc=example,dc=org"))...)
+	users = append(users, testdirectory.NewUsers(t, []string{"bob", "svc"})...)
+	groups := []*gldap.Entry{
+		testdirectory.NewGroup(t, "admins", []string{"alice"}),
+		testdirectory.NewGroup(t, "operators", []string{"bob"}),
+	}
+
+	opts = append(opts, testdirectory.WithDefaults(t, &testdirectory.Defaults{Users: users, Groups: groups}))
+	return testdirectory.Start(t, opts...)
+}
+
+func ldapConfig(t *testing.T, td *testdirectory.Directory, scheme string) LDAPConfig {
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM([]byte(td.Cert())))
+
+	config := DefaultLDAPConfig()
+	config.URL = fmt.Sprintf("%s://%s:%d", scheme, td.Host(), td.Port())
+	config.RootCAs = roots
+	config.BindDN = "cn=svc,ou=people,dc=example,dc=org"
+	config.BindPassword = "password"
+	config.UserBaseDN = "ou=people,dc=example,dc=org"
+	config.UserFilter = "(cn={username})"
+	config.UsernameAttribute = "name"
+	// the test directory does not understand the default lookup filter, which joins the user filter with an &
+	config.LookupFilter = "(cn={username})"
+	config.EmailAttribute = "email"
+	config.NameAttribute = "name"
+	return config
+}
+
+func TestLDAPMemberOf(t *testing.T) {
+	td := startDirectory(t)
+	a, err := NewLDAPAuth(ldapConfig(t, td, "ldaps"))
+	require.NoError(t, err)
+
+	u, ok := a.Authenticate("alice", "password")
+	require.True(t, ok)
+	require.Equal(t, "alice", u.GetID())
+	require.Equal(t, "alice@example.com", u.GetEmail())
+	require.Equal(t, "alice", u.GetName())
+	require.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=developers,ou=groups,dc=example,dc=org"}, u.GetGroups())
+	require.Equal(t, "cn=alice,ou=people,dc=example,dc=org", u.(*LDAPUser).DN)
+
+	// groups named alike in different parts of the directory are different groups
+	u, ok = a.Authenticate("carol", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"cn=admins,ou=contractors,dc=example,dc=org"}, u.GetGroups())
+
+	u, ok = a.Authenticate("bob", "password")
+	require.True(t, ok)
+	require.Empty(t, u.GetGroups())
+
+	_, ok = a.Authenticate("alice", "wrong")
+	require.False(t, ok)
+	_, ok = a.Authenticate("alice", "")
+	require.False(t, ok)
+	_, ok = a.Authenticate("mallory", "password")
+	require.False(t, ok)
+
+	// short group names are the first RDN values of the DNs
+	config := ldapConfig(t, td, "ldaps")
+	config.GroupNames = LDAPGroupNamesShort
+	a, err = NewLDAPAuth(config)
+	require.NoError(t, err)
+	u, ok = a.Authenticate("alice", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"admins", "developers"}, u.GetGroups())
+	u, ok = a.Authenticate("carol", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"admins"}, u.GetGroups())
+}
+
+func TestLDAPUsernameCase(t *testing.T) {
+	td := startDirectory(t)
+	config := ldapConfig(t, td, "ldaps")
+	// the test directory matches filters by case, so this filter finds alice however the username is typed, like a
+	// directory matching usernames without regard to case
+	config.UserFilter = "(|(cn=alice)(uid={username}))"
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+
+	totp := NewTOTP(NewMemoryTOTPStore(), "auth-proxy")
+	u, ok := a.Authenticate("alice", "password")
+	require.True(t, ok)
+	e, err := totp.Enrolment(TOTPUserKey(a.Name(), u.GetID()))
+	require.NoError(t, err)
+	code, err := TOTPCode(e.Secret, time.Now())
+	require.NoError(t, err)
+	_, ok, err = totp.Confirm(TOTPUserKey(a.Name(), u.GetID()), code)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the username is matched without regard to case, and the user gets the same ID and second factor
+	u, ok = a.Authenticate("ALICE", "password")
+	require.True(t, ok)
+	require.Equal(t, "alice", u.GetID())
+	e, err = totp.Enrolment(TOTPUserKey(a.Name(), u.GetID()))
+	require.NoError(t, err)
+	require.True(t, e.Confirmed)
+
+	// users without the username attribute have no ID, and are rejected
+	config.UsernameAttribute = "uid"
+	a, err = NewLDAPAuth(config)
+	require.NoError(t, err)
+	_, ok = a.Authenticate("alice", "password")
+	require.False(t, ok)
+}
+
+func TestLDAPLookup(t *testing.T) {
+	td := startDirectory(t)
+	a, err := NewLDAPAuth(ldapConfig(t, td, "ldaps"))
+	require.NoError(t, err)
+
+	u, ok := a.Lookup("alice")
+	require.True(t, ok)
+	require.Equal(t, "alice", u.GetID())
+	require.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=developers,ou=groups,dc=example,dc=org"}, u.GetGroups())
+	_, ok = a.Lookup("mallory")
+	require.False(t, ok)
+
+	// users are cached until the lookup TTL has passed, and are then searched for again
+	a.lookups["mallory"] = ldapLookup{user: &LDAPUser{Username: "mallory"}, expires: time.Now().Add(time.Minute)}
+	_, ok = a.Lookup("mallory")
+	require.True(t, ok)
+	a.lookups["mallory"] = ldapLookup{user: &LDAPUser{Username: "mallory"}, expires: time.Now().Add(-time.Second)}
+	_, ok = a.Lookup("mallory")
+	require.False(t, ok)
+}
+
+func TestLDAPGroupSearch(t *testing.T) {
+	td := startDirectory(t)
+	config := ldapConfig(t, td, "ldaps")
+	config.GroupBaseDN = "ou=groups,dc=example,dc=org"
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+
+	u, ok := a.Authenticate("alice", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=org"}, u.GetGroups())
+
+	u, ok = a.Authenticate("bob", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"cn=operators,ou=groups,dc=example,dc=org"}, u.GetGroups())
+
+	// short group names are read from the name attribute, or the first RDN value of the DN without it
+	config.GroupNames = LDAPGroupNamesShort
+	a, err = NewLDAPAuth(config)
+	require.NoError(t, err)
+	u, ok = a.Authenticate("bob", "password")
+	require.True(t, ok)
+	require.Equal(t, []string{"operators"}, u.GetGroups())
+}
+
+func TestLDAPLookupChangedUser(t *testing.T) {
+	td := startDirectory(t)
+	config := ldapConfig(t, td, "ldaps")
+	config.LookupTTL = time.Millisecond
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+
+	_, ok := a.Authenticate("alice", "password")
+	require.True(t, ok)
+	_, ok = a.Lookup("alice")
+	require.True(t, ok)
+	_, ok = a.Lookup("bob")
+	require.True(t, ok)
+
+	// alice is renamed, and bob is disabled, which removes him from the users found by the filters
+	users := testdirectory.NewUsers(t, []string{"alice2"},
+		testdirectory.WithMembersOf(t, testdirectory.NewMemberOf(t, []string{"admins"})...))
+	users = append(users, testdirectory.NewUsers(t, []string{"svc"})...)
+	td.SetUsers(users...)
+	time.Sleep(2 * config.LookupTTL)
+
+	// the filter of alice matches the DN of alice2, which does not have the ID of the session
+	_, ok = a.Lookup("alice")
+	require.False(t, ok)
+	_, ok = a.Lookup("bob")
+	require.False(t, ok)
+	u, ok := a.Lookup("alice2")
+	require.True(t, ok)
+	require.Equal(t, "alice2", u.GetID())
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	td := startDirectory(t, testdirectory.WithNoTLS(t))
+	config := ldapConfig(t, td, "ldap")
+	config.StartTLS = true
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+
+	_, ok := a.Authenticate("alice", "password")
+	require.True(t, ok)
+
+	// the certificate of the directory is not trusted
+	config.RootCAs = x509.NewCertPool()
+	a, err = NewLDAPAuth(config)
+	require.NoError(t, err)
+	_, ok = a.Authenticate("alice", "password")
+	require.False(t, ok)
+}
+
+func TestLDAPServiceAccount(t *testing.T) {
+	td := startDirectory(t)
+	config := ldapConfig(t, td, "ldaps")
+	config.BindPassword = "wrong"
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+
+	_, ok := a.Authenticate("alice", "password")
+	require.False(t, ok)
+}
+
+func TestLDAPConfig(t *testing.T) {
+	config := DefaultLDAPConfig()
+	config.UserBaseDN = "ou=people,dc=example,dc=org"
+
+	config.URL = "http://localhost"
+	_, err := NewLDAPAuth(config)
+	require.Error(t, err)
+
+	config.URL = "ldaps://localhost"
+	config.StartTLS = true
+	_, err = NewLDAPAuth(config)
+	require.Error(t, err)
+
+	config.URL = "ldap://localhost"
+	config.UserFilter = "(uid=alice)"
+	_, err = NewLDAPAuth(config)
+	require.Error(t, err)
+
+	config.UserFilter = DefaultLDAPUserFilter
+	config.LookupFilter = "(uid=alice)"
+	_, err = NewLDAPAuth(config)
+	require.Error(t, err)
+
+	config.LookupFilter = ""
+	config.GroupNames = "rdn"
+	_, err = NewLDAPAuth(config)
+	require.Error(t, err)
+
+	config.GroupNames = LDAPGroupNamesShort
+	a, err := NewLDAPAuth(config)
+	require.NoError(t, err)
+	require.Equal(t, "(&(uid={username})(uid={username}))", a.config.LookupFilter)
+}
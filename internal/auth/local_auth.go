@@ -2,15 +2,31 @@ package auth
 
 import (
 	"github.com/habakke/auth-proxy/internal/auth/providers"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
 )
 
+// LocalProviderName is recorded in sessions created by local authentication
+const LocalProviderName = "local"
+
+// Authenticator checks the credentials of the local login form
+type Authenticator interface {
+	// Name returns the provider recorded in the sessions of the users
+	Name() string
+	Authenticate(username string, password string) (providers.User, bool)
+	// Lookup returns the user with the ID without checking the password, or false if the user no longer exists
+	Lookup(id string) (providers.User, bool)
+}
+
 type LocalUser struct {
 	Username string
-	Password string
+	// PasswordHash is a bcrypt or argon2id hash of the password, as written by htpasswd -B
+	PasswordHash string
 }
 
 func (u LocalUser) GetID() string {
-	return ""
+	return u.Username
 }
 
 func (u LocalUser) GetUsername() string {
@@ -25,29 +41,101 @@ func (u LocalUser) GetEmail() string {
 	return ""
 }
 
+func (u LocalUser) GetEmailVerified() bool {
+	return false
+}
+
+func (u LocalUser) GetGroups() []string {
+	return nil
+}
+
 type LocalAuth struct {
+	mu    sync.RWMutex
 	users map[string]*LocalUser
+	// dummy is checked for unknown users, so they take as long to reject as known users with a wrong password
+	dummy *slowestDummy
+
+	watcher *fileWatcher
 }
 
 func NewAuthLocal() *LocalAuth {
 	return &LocalAuth{
 		users: make(map[string]*LocalUser),
+		dummy: newSlowestDummy(),
 	}
 }
 
+func (a *LocalAuth) Name() string {
+	return LocalProviderName
+}
+
 func (a *LocalAuth) AddUser(user *LocalUser) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	a.users[user.Username] = user
+	a.dummy.add(user.PasswordHash)
 }
 
 func (a *LocalAuth) RemoveUser(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	delete(a.users, username)
 }
 
+// setUsers replaces all users, as loaded from a file
+func (a *LocalAuth) setUsers(users map[string]*LocalUser) {
+	dummy := newSlowestDummy()
+	for _, u := range users {
+		dummy.add(u.PasswordHash)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	a.dummy = dummy
+}
+
+// Lookup returns the user with the username, which is the ID of local users
+func (a *LocalAuth) Lookup(id string) (providers.User, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.users[id]
+	if !ok {
+		return nil, false
+	}
+	return u, true
+}
+
+// Authenticate checks the password of the user. Unknown users are checked against a dummy hash with the same
+// parameters as the slowest hashes of known users, and checks of cheaper hashes are padded to as long, so users
+// can not be told apart by the time taken.
 func (a *LocalAuth) Authenticate(username string, password string) (providers.User, bool) {
-	if u, ok := a.users[username]; ok {
-		if u.Password == password {
-			return u, true
-		}
+	start := time.Now()
+	a.mu.RLock()
+	u, known := a.users[username]
+	dummy, slowest := a.dummy.hash, a.dummy.took
+	a.mu.RUnlock()
+	defer func() {
+		time.Sleep(slowest - time.Since(start))
+	}()
+
+	hash := dummy
+	if known {
+		hash = u.PasswordHash
+	}
+	if hash == "" {
+		hash = defaultDummyHash()
+	}
+
+	ok, err := checkPassword(hash, password)
+	if err != nil {
+		log.Error().AnErr("err", err).Str("username", username).Msg("failed to check password")
+	}
+	if !ok || !known {
+		return nil, false
 	}
-	return nil, false
+	return u, true
 }
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/habakke/auth-proxy/internal/session"
+	"io"
+	"sync"
+	"time"
+)
+
+// PasskeyCeremonyTimeout is how long users have to complete the registration or login with their authenticator
+const PasskeyCeremonyTimeout = 5 * time.Minute
+
+// ErrPasskeyCloned is returned for assertions with a sign counter which has not increased, which means that the
+// private key of the passkey has been copied to another authenticator
+var ErrPasskeyCloned = errors.New("sign counter of passkey did not increase, it may be cloned")
+
+// PasskeyUser is the account passkeys were registered for, which the user is signed in as with any of them
+type PasskeyUser struct {
+	// Handle is the random WebAuthn user handle, which discoverable credentials return on login
+	Handle []byte `json:"handle"`
+
+	Provider      string   `json:"provider"`
+	ID            string   `json:"id"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	HostedDomain  string   `json:"hd,omitempty"`
+
+	Credentials []webauthn.Credential `json:"credentials"`
+}
+
+// Key returns the key the passkeys of the user are stored with
+func (u *PasskeyUser) Key() string {
+	return session.UserKey(u.Provider, u.ID)
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte {
+	return u.Handle
+}
+
+func (u *PasskeyUser) WebAuthnName() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.ID
+}
+
+func (u *PasskeyUser) WebAuthnDisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.WebAuthnName()
+}
+
+func (u *PasskeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// Session returns the session of the account the passkeys were registered for. It only identifies the account, as
+// the profile stored with the passkeys may be outdated, and must be looked up again.
+func (u *PasskeyUser) Session() session.Data {
+	return session.Data{
+		ID:       u.ID,
+		Provider: u.Provider,
+	}
+}
+
+// Passkeys registers passkeys for signed in users, and signs users in with them without a password
+type Passkeys struct {
+	// mu serializes updates of the credentials, so sign counters are compared with the latest value
+	mu       sync.Mutex
+	webauthn *webauthn.WebAuthn
+	store    PasskeyStore
+}
+
+// NewPasskeys returns passkeys for the relying party ID, which is the domain of the proxy or a parent domain of it,
+// accepting ceremonies from the origins
+func NewPasskeys(rpID string, rpName string, origins []string, store PasskeyStore) (*Passkeys, error) {
+	if len(origins) == 0 {
+		origins = []string{"https://" + rpID}
+	}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		// passkeys are discoverable, and replace both the username and the password
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+		AttestationPreference: protocol.PreferNoAttestation,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: PasskeyCeremonyTimeout, TimeoutUVD: PasskeyCeremonyTimeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: PasskeyCeremonyTimeout, TimeoutUVD: PasskeyCeremonyTimeout},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Passkeys{webauthn: w, store: store}, nil
+}
+
+// user returns the stored passkey user of the session, or a new one with a random handle, with the profile of the
+// session
+func (p *Passkeys) user(s *session.Data) (*PasskeyUser, error) {
+	u, err := p.store.Get(session.UserKey(s.Provider, s.ID))
+	if errors.Is(err, ErrNoPasskeys) {
+		u = &PasskeyUser{Handle: make([]byte, 32)}
+		if _, err = rand.Read(u.Handle); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	u.Provider = s.Provider
+	u.ID = s.ID
+	u.Email = s.Email
+	u.EmailVerified = s.EmailVerified
+	u.Name = s.Name
+	u.Groups = s.Groups
+	u.HostedDomain = s.HostedDomain
+	return u, nil
+}
+
+// Credentials returns the passkeys registered for the user of the session
+func (p *Passkeys) Credentials(s *session.Data) ([]webauthn.Credential, error) {
+	u, err := p.store.Get(session.UserKey(s.Provider, s.ID))
+	if errors.Is(err, ErrNoPasskeys) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.Credentials, nil
+}
+
+// BeginRegistration returns the options for creating a passkey for the user of the session, and the state of the
+// ceremony, which must be kept until it is finished
+func (p *Passkeys) BeginRegistration(s *session.Data) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	u, err := p.user(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var exclusions []protocol.CredentialDescriptor
+	for _, c := range u.Credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+	return p.webauthn.BeginRegistration(u, webauthn.WithExclusions(exclusions))
+}
+
+// FinishRegistration verifies the new passkey created by the authenticator, and stores it for the user of the
+// session
+func (p *Passkeys) FinishRegistration(s *session.Data, state webauthn.SessionData, body io.Reader) (*webauthn.Credential, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, err := p.user(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Credentials) == 0 {
+		// the user was not stored when the ceremony began, so the handle is the one sent to the authenticator
+		u.Handle = state.UserID
+	}
+	if !bytes.Equal(u.Handle, state.UserID) {
+		return nil, fmt.Errorf("registration was started for another user")
+	}
+
+	c, err := p.webauthn.CreateCredential(u, state, parsed)
+	if err != nil {
+		return nil, err
+	}
+	u.Credentials = append(u.Credentials, *c)
+	if err = p.store.Put(u); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BeginLogin returns the options for signing in with any passkey of the relying party, and the state of the
+// ceremony, which must be kept until it is finished
+func (p *Passkeys) BeginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return p.webauthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+}
+
+// FinishLogin verifies the assertion of the authenticator, and returns the user the passkey belongs to. Passkeys
+// whose sign counter has not increased since the last login are rejected with ErrPasskeyCloned, which is returned
+// together with the user.
+func (p *Passkeys) FinishLogin(state webauthn.SessionData, body io.Reader) (*PasskeyUser, error) {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var u *PasskeyUser
+	c, err := p.webauthn.ValidateDiscoverableLogin(func(_, handle []byte) (webauthn.User, error) {
+		var err error
+		u, err = p.store.GetByHandle(handle)
+		return u, err
+	}, state, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if c.Authenticator.CloneWarning {
+		return u, ErrPasskeyCloned
+	}
+
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].ID, c.ID) {
+			u.Credentials[i] = *c
+		}
+	}
+	if err = p.store.Put(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Remove deletes all passkeys of the user of the session
+func (p *Passkeys) Remove(s *session.Data) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.store.Delete(session.UserKey(s.Provider, s.ID))
+}
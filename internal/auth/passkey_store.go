@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var ErrNoPasskeys = errors.New("user has no passkeys")
+
+// PasskeyStore keeps the passkeys of the users, keyed by the provider and ID of the user
+type PasskeyStore interface {
+	// Get returns the user with the key, or ErrNoPasskeys
+	Get(userKey string) (*PasskeyUser, error)
+	// GetByHandle returns the user with the WebAuthn user handle, or ErrNoPasskeys
+	GetByHandle(handle []byte) (*PasskeyUser, error)
+	Put(u *PasskeyUser) error
+	Delete(userKey string) error
+	Close() error
+}
+
+func copyPasskeyUser(u *PasskeyUser) *PasskeyUser {
+	c := *u
+	c.Groups = append([]string(nil), u.Groups...)
+	c.Credentials = append(c.Credentials[:0:0], u.Credentials...)
+	return &c
+}
+
+// MemoryPasskeyStore keeps the passkeys in memory, so they are lost on restart
+type MemoryPasskeyStore struct {
+	mu      sync.Mutex
+	users   map[string]*PasskeyUser
+	handles map[string]string
+}
+
+func NewMemoryPasskeyStore() *MemoryPasskeyStore {
+	return &MemoryPasskeyStore{
+		users:   make(map[string]*PasskeyUser),
+		handles: make(map[string]string),
+	}
+}
+
+func (s *MemoryPasskeyStore) Get(userKey string) (*PasskeyUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userKey]
+	if !ok {
+		return nil, ErrNoPasskeys
+	}
+	return copyPasskeyUser(u), nil
+}
+
+func (s *MemoryPasskeyStore) GetByHandle(handle []byte) (*PasskeyUser, error) {
+	s.mu.Lock()
+	key, ok := s.handles[string(handle)]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNoPasskeys
+	}
+	return s.Get(key)
+}
+
+func (s *MemoryPasskeyStore) Put(u *PasskeyUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[u.Key()] = copyPasskeyUser(u)
+	s.handles[string(u.Handle)] = u.Key()
+	return nil
+}
+
+func (s *MemoryPasskeyStore) Delete(userKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userKey]; ok {
+		delete(s.handles, string(u.Handle))
+		delete(s.users, userKey)
+	}
+	return nil
+}
+
+func (s *MemoryPasskeyStore) Close() error {
+	return nil
+}
+
+var (
+	passkeysBucket       = []byte("passkeys")
+	passkeyHandlesBucket = []byte("passkey_handles")
+)
+
+// BoltPasskeyStore keeps the passkeys in a local BoltDB file
+type BoltPasskeyStore struct {
+	db *bolt.DB
+}
+
+func NewBoltPasskeyStore(path string) (*BoltPasskeyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open passkey database: %s", err.Error())
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{passkeysBucket, passkeyHandlesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize passkey database: %s", err.Error())
+	}
+
+	return &BoltPasskeyStore{db: db}, nil
+}
+
+func getPasskeyUser(tx *bolt.Tx, userKey []byte) (*PasskeyUser, error) {
+	v := tx.Bucket(passkeysBucket).Get(userKey)
+	if v == nil {
+		return nil, ErrNoPasskeys
+	}
+	u := &PasskeyUser{}
+	if err := json.Unmarshal(v, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *BoltPasskeyStore) Get(userKey string) (*PasskeyUser, error) {
+	var u *PasskeyUser
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		u, err = getPasskeyUser(tx, []byte(userKey))
+		return err
+	})
+	return u, err
+}
+
+func (s *BoltPasskeyStore) GetByHandle(handle []byte) (*PasskeyUser, error) {
+	var u *PasskeyUser
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(passkeyHandlesBucket).Get(handle)
+		if key == nil {
+			return ErrNoPasskeys
+		}
+		var err error
+		u, err = getPasskeyUser(tx, key)
+		return err
+	})
+	return u, err
+}
+
+func (s *BoltPasskeyStore) Put(u *PasskeyUser) error {
+	v, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(passkeysBucket).Put([]byte(u.Key()), v); err != nil {
+			return err
+		}
+		return tx.Bucket(passkeyHandlesBucket).Put(u.Handle, []byte(u.Key()))
+	})
+}
+
+func (s *BoltPasskeyStore) Delete(userKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		u, err := getPasskeyUser(tx, []byte(userKey))
+		if errors.Is(err, ErrNoPasskeys) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := tx.Bucket(passkeyHandlesBucket).Delete(u.Handle); err != nil {
+			return err
+		}
+		return tx.Bucket(passkeysBucket).Delete([]byte(userKey))
+	})
+}
+
+func (s *BoltPasskeyStore) Close() error {
+	return s.db.Close()
+}
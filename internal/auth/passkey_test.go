@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/habakke/auth-proxy/pkg/util/testutils"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func registerPasskey(t *testing.T, passkeys *Passkeys, authenticator *testutils.Authenticator, s *session.Data) {
+	options, state, err := passkeys.BeginRegistration(s)
+	require.NoError(t, err)
+	o, err := json.Marshal(options)
+	require.NoError(t, err)
+	credential, err := authenticator.Create(o)
+	require.NoError(t, err)
+	_, err = passkeys.FinishRegistration(s, *state, bytes.NewReader(credential))
+	require.NoError(t, err)
+}
+
+func loginWithPasskey(t *testing.T, passkeys *Passkeys, authenticator *testutils.Authenticator) (*PasskeyUser, error) {
+	options, state, err := passkeys.BeginLogin()
+	require.NoError(t, err)
+	o, err := json.Marshal(options)
+	require.NoError(t, err)
+	assertion, err := authenticator.Get(o)
+	require.NoError(t, err)
+	return passkeys.FinishLogin(*state, bytes.NewReader(assertion))
+}
+
+func TestPasskeys(t *testing.T) {
+	stores := map[string]PasskeyStore{
+		"memory": NewMemoryPasskeyStore(),
+	}
+	bolt, err := NewBoltPasskeyStore(filepath.Join(t.TempDir(), "passkeys.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	stores["bolt"] = bolt
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			passkeys, err := NewPasskeys("example.com", "Example", nil, store)
+			require.NoError(t, err)
+			authenticator := testutils.NewAuthenticator("https://example.com")
+
+			s := &session.Data{ID: "1234", Email: "alice@example.com", EmailVerified: true, Name: "Alice", Groups: []string{"admins"}, Provider: "GitHub"}
+			registerPasskey(t, passkeys, authenticator, s)
+			credentials, err := passkeys.Credentials(s)
+			require.NoError(t, err)
+			require.Len(t, credentials, 1)
+
+			// the account the passkey was registered for is identified, without the stored profile
+			u, err := loginWithPasskey(t, passkeys, authenticator)
+			require.NoError(t, err)
+			require.Equal(t, session.Data{ID: s.ID, Provider: s.Provider}, u.Session())
+			u, err = loginWithPasskey(t, passkeys, authenticator)
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), u.Credentials[0].Authenticator.SignCount)
+
+			// a second passkey is added to the same user
+			second := testutils.NewAuthenticator("https://example.com")
+			registerPasskey(t, passkeys, second, s)
+			credentials, err = passkeys.Credentials(s)
+			require.NoError(t, err)
+			require.Len(t, credentials, 2)
+			u, err = loginWithPasskey(t, passkeys, second)
+			require.NoError(t, err)
+			require.Equal(t, s.ID, u.ID)
+
+			// a copy of the passkey is detected by its sign counter, which is behind the stored one
+			clone := authenticator.Clone()
+			_, err = loginWithPasskey(t, passkeys, authenticator)
+			require.NoError(t, err)
+			_, err = loginWithPasskey(t, passkeys, clone)
+			require.ErrorIs(t, err, ErrPasskeyCloned)
+
+			// assertions for other origins are rejected
+			phishing := authenticator.Clone()
+			phishing.Origin = "https://example.org"
+			_, err = loginWithPasskey(t, passkeys, phishing)
+			require.Error(t, err)
+
+			require.NoError(t, passkeys.Remove(s))
+			_, err = loginWithPasskey(t, passkeys, authenticator)
+			require.Error(t, err)
+			credentials, err = passkeys.Credentials(s)
+			require.NoError(t, err)
+			require.Empty(t, credentials)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// argon2idParams are the parameters of an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+const (
+	argon2idMinSaltLength = 8
+	argon2idMinHashLength = 4
+	// the maximums keep a single line of the users file from making every login allocate or compute without bounds
+	argon2idMaxMemory      = 1 << 20 // KiB
+	argon2idMaxIterations  = 16
+	argon2idMaxParallelism = 16
+	argon2idMaxHashLength  = 64
+	bcryptMaxCost          = 16
+)
+
+func parseArgon2id(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	p := &argon2idParams{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	// argon2 panics on parameters below the minimums of RFC 9106
+	if p.iterations < 1 || p.parallelism < 1 || p.memory < 8*uint32(p.parallelism) {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if p.memory > argon2idMaxMemory || p.iterations > argon2idMaxIterations || p.parallelism > argon2idMaxParallelism {
+		return nil, fmt.Errorf("argon2id parameters %q exceed m=%d,t=%d,p=%d", parts[3], argon2idMaxMemory, argon2idMaxIterations, argon2idMaxParallelism)
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(p.salt) < argon2idMinSaltLength {
+		return nil, fmt.Errorf("invalid argon2id salt")
+	}
+	if p.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.hash) < argon2idMinHashLength || len(p.hash) > argon2idMaxHashLength {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	return p, nil
+}
+
+func (p *argon2idParams) derive(password string) []byte {
+	return argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.hash)))
+}
+
+func (p *argon2idParams) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(p.salt), base64.RawStdEncoding.EncodeToString(p.hash))
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func isArgon2id(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// validateHash returns an error unless the hash is a bcrypt or argon2id hash
+func validateHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err == nil && cost > bcryptMaxCost {
+			return fmt.Errorf("bcrypt cost %d exceeds %d", cost, bcryptMaxCost)
+		}
+		return err
+	case isArgon2id(hash):
+		_, err := parseArgon2id(hash)
+		return err
+	}
+	return fmt.Errorf("unsupported password hash, only bcrypt and argon2id are supported")
+}
+
+// checkPassword compares the password with the hash in constant time
+func checkPassword(hash string, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case isArgon2id(hash):
+		p, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(p.derive(password), p.hash) == 1, nil
+	}
+	return false, fmt.Errorf("unsupported password hash")
+}
+
+// HashPassword returns a bcrypt hash of the password with the default cost
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// dummyHash returns a hash of a random password with the same algorithm and parameters as the hash
+func dummyHash(hash string) string {
+	password := make([]byte, 16)
+	_, _ = rand.Read(password)
+
+	switch {
+	case isBcrypt(hash):
+		if cost, err := bcrypt.Cost([]byte(hash)); err == nil {
+			if dummy, err := bcrypt.GenerateFromPassword(password, cost); err == nil {
+				return string(dummy)
+			}
+		}
+	case isArgon2id(hash):
+		if p, err := parseArgon2id(hash); err == nil {
+			p.salt = make([]byte, len(p.salt))
+			_, _ = rand.Read(p.salt)
+			p.hash = p.derive(string(password))
+			return p.String()
+		}
+	}
+	return defaultDummyHash()
+}
+
+// hashParams returns the algorithm and parameters of the hash, which decide how long it takes to check
+func hashParams(hash string) string {
+	switch {
+	case isBcrypt(hash):
+		if cost, err := bcrypt.Cost([]byte(hash)); err == nil {
+			return fmt.Sprintf("bcrypt:%d", cost)
+		}
+	case isArgon2id(hash):
+		if p, err := parseArgon2id(hash); err == nil {
+			return fmt.Sprintf("argon2id:%d,%d,%d,%d", p.memory, p.iterations, p.parallelism, len(p.hash))
+		}
+	}
+	return ""
+}
+
+// slowestDummy keeps a dummy hash with the parameters of the hashes which take the longest to check, so unknown
+// users take at least as long to reject as any known user, whatever the order the hashes are added in. Checks of
+// cheaper hashes are padded to as long as it took to compute the dummy.
+type slowestDummy struct {
+	hash   string
+	took   time.Duration
+	params map[string]bool
+}
+
+func newSlowestDummy() *slowestDummy {
+	return &slowestDummy{params: make(map[string]bool)}
+}
+
+// add creates a dummy hash with the parameters of the hash, unless one was created before, and keeps it if it took
+// longer to compute than the current one
+func (d *slowestDummy) add(hash string) {
+	key := hashParams(hash)
+	if key == "" || d.params[key] {
+		return
+	}
+	d.params[key] = true
+
+	start := time.Now()
+	dummy := dummyHash(hash)
+	if took := time.Since(start); took > d.took {
+		d.hash = dummy
+		d.took = took
+	}
+}
+
+var defaultDummy struct {
+	once sync.Once
+	hash string
+}
+
+// defaultDummyHash returns a bcrypt hash of a random password with the default cost, for when there are no users
+func defaultDummyHash() string {
+	defaultDummy.once.Do(func() {
+		password := make([]byte, 16)
+		_, _ = rand.Read(password)
+		hash, _ := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		defaultDummy.hash = string(hash)
+	})
+	return defaultDummy.hash
+}
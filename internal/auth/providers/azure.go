@@ -0,0 +1,300 @@
+package providers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/habakke/auth-proxy/pkg/helper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const azureAuthorityURL = "https://login.microsoftonline.com"
+const azureGraphURL = "https://graph.microsoft.com"
+
+type AzureUserInfo struct {
+	Subject           string            `json:"sub"`
+	ObjectID          string            `json:"oid"`
+	TenantID          string            `json:"tid"`
+	Issuer            string            `json:"iss"`
+	Email             string            `json:"email,omitempty"`
+	EmailVerified     bool              `json:"xms_edov,omitempty"`
+	PreferredUsername string            `json:"preferred_username,omitempty"`
+	Name              string            `json:"name,omitempty"`
+	Groups            []string          `json:"groups,omitempty"`
+	Nonce             string            `json:"nonce,omitempty"`
+	ClaimNames        map[string]string `json:"_claim_names,omitempty"`
+}
+
+func (u AzureUserInfo) GetID() string {
+	return u.ObjectID
+}
+
+func (u AzureUserInfo) GetUsername() string {
+	return u.PreferredUsername
+}
+
+func (u AzureUserInfo) GetName() string {
+	return u.Name
+}
+
+func (u AzureUserInfo) GetEmail() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.PreferredUsername
+}
+
+// GetEmailVerified returns the optional xms_edov claim, as the email claim of multi-tenant apps may hold any
+// address chosen by the tenant admin. The claim must be added to the app registration to use email allow lists.
+func (u AzureUserInfo) GetEmailVerified() bool {
+	return u.EmailVerified
+}
+
+func (u AzureUserInfo) GetGroups() []string {
+	return u.Groups
+}
+
+// hasGroupOverage is true when the user is member of too many groups to fit in the token, and the
+// groups claim has been replaced by a reference to Microsoft Graph
+func (u AzureUserInfo) hasGroupOverage() bool {
+	_, ok := u.ClaimNames["groups"]
+	return ok
+}
+
+// AzureProvider authenticates users with the Microsoft identity platform (Entra ID) v2.0 endpoints.
+// Groups are reported by their object ID.
+type AzureProvider struct {
+	*ProviderData
+	Config   *oauth2.Config
+	Verifier *oidc.IDTokenVerifier
+
+	// AuthorityURL is the URL of the Microsoft identity platform
+	AuthorityURL string
+	// GraphURL is the URL of Microsoft Graph, used to resolve groups on overage
+	GraphURL string
+	// Tenant is a tenant ID for single-tenant apps, or common, organizations or consumers for multi-tenant apps
+	Tenant string
+	// AllowedTenants restricts login to users from the listed tenant IDs
+	AllowedTenants []string
+	// Groups restricts login to members of any of the listed group object IDs
+	Groups []string
+}
+
+func NewAzureProvider(p *ProviderData, authorityURL string, tenant string, config *oauth2.Config) *AzureProvider {
+	p.Name = "Azure"
+	if p.DisplayName == "" {
+		p.DisplayName = "Microsoft"
+	}
+	authorityURL = strings.TrimSuffix(authorityURL, "/")
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  fmt.Sprintf("%s/%s/oauth2/v2.0/authorize", authorityURL, tenant),
+		TokenURL: fmt.Sprintf("%s/%s/oauth2/v2.0/token", authorityURL, tenant),
+	}
+
+	a := &AzureProvider{
+		ProviderData: p,
+		Config:       config,
+		AuthorityURL: authorityURL,
+		GraphURL:     azureGraphURL,
+		Tenant:       tenant,
+	}
+
+	// Multi-tenant apps receive tokens issued by the tenant of the user, so the issuer is checked
+	// against the tid claim after verification instead
+	keySet := oidc.NewRemoteKeySet(context.Background(), fmt.Sprintf("%s/%s/discovery/v2.0/keys", authorityURL, tenant))
+	a.Verifier = oidc.NewVerifier(a.issuer(tenant), keySet, &oidc.Config{
+		ClientID:        config.ClientID,
+		SkipIssuerCheck: a.isMultiTenant(),
+	})
+	return a
+}
+
+func (p *AzureProvider) Data() *ProviderData {
+	return p.ProviderData
+}
+
+func (p *AzureProvider) isMultiTenant() bool {
+	switch strings.ToLower(p.Tenant) {
+	case "common", "organizations", "consumers":
+		return true
+	}
+	return false
+}
+
+func (p *AzureProvider) issuer(tenantID string) string {
+	return fmt.Sprintf("%s/%s/v2.0", p.AuthorityURL, tenantID)
+}
+
+func (p *AzureProvider) isAllowedTenant(tenantID string) bool {
+	if len(p.AllowedTenants) == 0 {
+		return true
+	}
+	for _, t := range p.AllowedTenants {
+		if strings.EqualFold(t, tenantID) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyIDToken checks the signature, audience and expiry of the ID token, that it was issued by an
+// allowed tenant, and that the nonce matches the one sent with the authorization request
+func (p *AzureProvider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*AzureUserInfo, error) {
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify id_token: %s", err.Error())
+	}
+
+	var user = AzureUserInfo{}
+	if err := idToken.Claims(&user); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %s", err.Error())
+	}
+
+	if user.Issuer != p.issuer(user.TenantID) {
+		return nil, fmt.Errorf("id_token issuer %s does not match tenant %s", user.Issuer, user.TenantID)
+	}
+	if !p.isAllowedTenant(user.TenantID) {
+		return nil, fmt.Errorf("tenant %s is not allowed", user.TenantID)
+	}
+	if subtle.ConstantTimeCompare([]byte(user.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("id_token nonce does not match")
+	}
+	return &user, nil
+}
+
+// getGraphGroups returns the object IDs of all groups the user is a transitive member of
+func (p *AzureProvider) getGraphGroups(ctx context.Context, token *Token) ([]string, error) {
+	var groups []string
+	next := p.GraphURL + "/v1.0/me/transitiveMemberOf/microsoft.graph.group?$select=id"
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed getting groups: %s", err.Error())
+		}
+		data, err := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed read response: %s", err.Error())
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed getting groups: %s", response.Status)
+		}
+
+		var page struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			log.Info().AnErr("err", err).Str("data", string(data)).Msg("failed to unmarshal Graph groups")
+			return nil, fmt.Errorf("failed to unmarshal Graph groups")
+		}
+		for _, g := range page.Value {
+			groups = append(groups, g.ID)
+		}
+		next = page.NextLink
+	}
+	return groups, nil
+}
+
+// GetUser returns the user in the ID token verified by Exchange, with the groups resolved through Graph if they
+// did not fit in the token
+func (p *AzureProvider) GetUser(ctx context.Context, token *Token) (User, error) {
+	if token == nil {
+		return nil, fmt.Errorf("no id_token available")
+	}
+	user, ok := token.Claims.(AzureUserInfo)
+	if !ok {
+		return nil, fmt.Errorf("no verified id_token available")
+	}
+
+	if user.hasGroupOverage() {
+		log.Debug().Str("id", user.GetID()).Msg("groups claim overage, resolving groups through Graph")
+		groups, err := p.getGraphGroups(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		user.Groups = groups
+	}
+	return user, nil
+}
+
+func GetAzureOauthConfig() *oauth2.Config {
+	azureOauthCallbackURL, err := helper.GetStringEnv("AZURE_OAUTH_CALLBACK_URL")
+	helper.HandleError(err, true, "AZURE_OAUTH_CALLBACK_URL environment variable not set")
+	azureOauthClientID, err := helper.GetStringEnv("AZURE_OAUTH_CLIENT_ID")
+	helper.HandleError(err, true, "AZURE_OAUTH_CLIENT_ID environment variable not set")
+	azureOauthClientSecret, err := helper.GetStringEnv("AZURE_OAUTH_CLIENT_SECRET")
+	helper.HandleError(err, true, "AZURE_OAUTH_CLIENT_SECRET environment variable not set")
+
+	return &oauth2.Config{
+		RedirectURL:  azureOauthCallbackURL, // Ex. https://<domain>/auth/azure/callback
+		ClientID:     azureOauthClientID,
+		ClientSecret: azureOauthClientSecret,
+		Scopes:       []string{"openid", "email", "profile", "User.Read"},
+	}
+}
+
+func (p *AzureProvider) Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error) {
+	token, err := exchange(ctx, p.Config, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response did not contain an id_token")
+	}
+	user, err := p.VerifyIDToken(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		IDToken:      rawIDToken,
+		Expiry:       token.Expiry,
+		Claims:       *user,
+	}, nil
+}
+
+func (p *AzureProvider) GetCallbackPath() string {
+	return fmt.Sprintf("/auth/%s/callback", strings.ToLower(p.Name))
+}
+
+func (p *AzureProvider) GetLoginPath() string {
+	return fmt.Sprintf("/auth/%s/login", strings.ToLower(p.Name))
+}
+
+func (p *AzureProvider) GetProviderLoginURL(state *session.LoginState) (*url.URL, error) {
+	return authCodeURL(p.Config, state, oidc.Nonce(state.Nonce))
+}
+
+// AuthenticateSession accepts the session if no groups are configured, or if the user is a member of
+// one of the allowed groups
+func (p *AzureProvider) AuthenticateSession(data *session.Data) bool {
+	if !p.AuthenticateEmail(data) {
+		return false
+	}
+	if len(p.Groups) == 0 {
+		return true
+	}
+
+	return data.InGroup(p.Groups...)
+}
@@ -0,0 +1,152 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testTenantID  = "11111111-1111-1111-1111-111111111111"
+	otherTenantID = "22222222-2222-2222-2222-222222222222"
+)
+
+type testAuthority struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	authority := &testAuthority{key: key}
+	mux := http.NewServeMux()
+	keys := func(res http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(res).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	}
+	mux.HandleFunc("/common/discovery/v2.0/keys", keys)
+	mux.HandleFunc("/"+testTenantID+"/discovery/v2.0/keys", keys)
+	mux.HandleFunc("/common/oauth2/v2.0/token", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     authority.idToken,
+		})
+	})
+	mux.HandleFunc("/v1.0/me/transitiveMemberOf/microsoft.graph.group", func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer access" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("page") == "" {
+			_ = json.NewEncoder(res).Encode(map[string]interface{}{
+				"value":           []map[string]string{{"id": "group-1"}},
+				"@odata.nextLink": authority.URL + req.URL.Path + "?page=2",
+			})
+			return
+		}
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{
+			"value": []map[string]string{{"id": "group-2"}},
+		})
+	})
+	authority.Server = httptest.NewServer(mux)
+	t.Cleanup(authority.Close)
+	return authority
+}
+
+func (a *testAuthority) claims(tenantID string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                a.URL + "/" + tenantID + "/v2.0",
+		"aud":                testClientID,
+		"sub":                "pairwise-subject",
+		"oid":                "object-id",
+		"tid":                tenantID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              testNonce,
+		"name":               "Test Ninja",
+		"preferred_username": "ninja@example.com",
+		"groups":             []string{"group-1"},
+	}
+}
+
+func newTestAzureProvider(authority *testAuthority, tenant string) *AzureProvider {
+	p := NewAzureProvider(&ProviderData{}, authority.URL, tenant, &oauth2.Config{ClientID: testClientID})
+	p.GraphURL = authority.URL
+	return p
+}
+
+func TestAzureSingleTenant(t *testing.T) {
+	authority := newTestAuthority(t)
+	p := newTestAzureProvider(authority, testTenantID)
+	require.Equal(t, "/auth/azure/login", p.GetLoginPath())
+
+	user, err := p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, authority.claims(testTenantID)), testNonce)
+	require.NoError(t, err)
+	require.Equal(t, "object-id", user.GetID())
+	require.Equal(t, "ninja@example.com", user.GetEmail())
+	require.Equal(t, []string{"group-1"}, user.GetGroups())
+
+	_, err = p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, authority.claims(otherTenantID)), testNonce)
+	require.Error(t, err)
+}
+
+func TestAzureMultiTenant(t *testing.T) {
+	authority := newTestAuthority(t)
+	p := newTestAzureProvider(authority, "common")
+
+	for _, tenantID := range []string{testTenantID, otherTenantID} {
+		_, err := p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, authority.claims(tenantID)), testNonce)
+		require.NoError(t, err)
+	}
+
+	p.AllowedTenants = []string{testTenantID}
+	_, err := p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, authority.claims(testTenantID)), testNonce)
+	require.NoError(t, err)
+	_, err = p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, authority.claims(otherTenantID)), testNonce)
+	require.Error(t, err)
+
+	// The issuer must match the tenant of the token
+	claims := authority.claims(testTenantID)
+	claims["iss"] = authority.URL + "/" + otherTenantID + "/v2.0"
+	_, err = p.VerifyIDToken(context.Background(), signTestToken(t, authority.key, claims), testNonce)
+	require.Error(t, err)
+}
+
+func TestAzureGroupOverage(t *testing.T) {
+	authority := newTestAuthority(t)
+	claims := authority.claims(testTenantID)
+	delete(claims, "groups")
+	claims["_claim_names"] = map[string]string{"groups": "src1"}
+	claims["_claim_sources"] = map[string]interface{}{"src1": map[string]string{"endpoint": "https://graph.windows.net/"}}
+	authority.idToken = signTestToken(t, authority.key, claims)
+	p := newTestAzureProvider(authority, "common")
+
+	token, err := p.Exchange(context.Background(), "code", testLoginState(testNonce))
+	require.NoError(t, err)
+	user, err := p.GetUser(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, []string{"group-1", "group-2"}, user.GetGroups())
+	_, err = p.GetUser(context.Background(), &Token{AccessToken: token.AccessToken, IDToken: token.IDToken})
+	require.Error(t, err)
+
+	p.Groups = []string{"group-2"}
+	require.True(t, p.AuthenticateSession(&session.Data{Groups: user.GetGroups()}))
+	p.Groups = []string{"group-3"}
+	require.False(t, p.AuthenticateSession(&session.Data{Groups: user.GetGroups()}))
+}
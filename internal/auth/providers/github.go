@@ -0,0 +1,234 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/habakke/auth-proxy/pkg/helper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const githubAPIURL = "https://api.github.com"
+const githubPageSize = 100
+
+type GitHubUserInfo struct {
+	ID     int64    `json:"id"`
+	Login  string   `json:"login"`
+	Name   string   `json:"name,omitempty"`
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"-"`
+}
+
+func (u GitHubUserInfo) GetID() string {
+	return strconv.FormatInt(u.ID, 10)
+}
+
+func (u GitHubUserInfo) GetUsername() string {
+	return u.Login
+}
+
+func (u GitHubUserInfo) GetName() string {
+	return u.Name
+}
+
+func (u GitHubUserInfo) GetEmail() string {
+	return u.Email
+}
+
+// GetEmailVerified is true for all users, as only the verified primary email address is used
+func (u GitHubUserInfo) GetEmailVerified() bool {
+	return u.Email != ""
+}
+
+func (u GitHubUserInfo) GetGroups() []string {
+	return u.Groups
+}
+
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+type githubOrg struct {
+	Login string `json:"login"`
+}
+
+type githubTeam struct {
+	Slug         string    `json:"slug"`
+	Organization githubOrg `json:"organization"`
+}
+
+// GitHubProvider authenticates users with GitHub. Organizations are reported as groups named after the
+// organization login, and teams as "<org>/<team-slug>".
+type GitHubProvider struct {
+	*ProviderData
+	Config *oauth2.Config
+
+	// APIURL is the base URL of the GitHub REST API
+	APIURL string
+	// Orgs and Teams restrict login to members of any of the listed organizations or teams
+	Orgs  []string
+	Teams []string
+}
+
+func NewGitHubProvider(p *ProviderData, config *oauth2.Config) *GitHubProvider {
+	p.Name = "GitHub"
+	return &GitHubProvider{
+		ProviderData: p,
+		Config:       config,
+		APIURL:       githubAPIURL,
+	}
+}
+
+func (p *GitHubProvider) Data() *ProviderData {
+	return p.ProviderData
+}
+
+func (p *GitHubProvider) get(ctx context.Context, token *Token, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.APIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", path, err.Error())
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed read response: %s", err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %s: %s", path, response.Status)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Info().AnErr("err", err).Str("data", string(data)).Msgf("failed to unmarshal GitHub %s", path)
+		return fmt.Errorf("failed to unmarshal GitHub %s", path)
+	}
+	return nil
+}
+
+// getPages collects every page of a paginated list endpoint
+func getPages[T any](ctx context.Context, p *GitHubProvider, token *Token, path string) ([]T, error) {
+	var all []T
+	for page := 1; ; page++ {
+		var items []T
+		if err := p.get(ctx, token, fmt.Sprintf("%s?per_page=%d&page=%d", path, githubPageSize, page), &items); err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if len(items) < githubPageSize {
+			return all, nil
+		}
+	}
+}
+
+func (p *GitHubProvider) GetUser(ctx context.Context, token *Token) (User, error) {
+	var user = GitHubUserInfo{}
+	if err := p.get(ctx, token, "/user", &user); err != nil {
+		return nil, err
+	}
+
+	// The public profile email is optional, so always use the verified primary address
+	emails, err := getPages[githubEmail](ctx, p, token, "/user/emails")
+	if err != nil {
+		return nil, err
+	}
+	user.Email = ""
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			user.Email = e.Email
+		}
+	}
+	if user.Email == "" {
+		return nil, fmt.Errorf("GitHub user %s has no verified primary email", user.Login)
+	}
+
+	orgs, err := getPages[githubOrg](ctx, p, token, "/user/orgs")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orgs {
+		user.Groups = append(user.Groups, o.Login)
+	}
+
+	teams, err := getPages[githubTeam](ctx, p, token, "/user/teams")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		user.Groups = append(user.Groups, fmt.Sprintf("%s/%s", t.Organization.Login, t.Slug))
+	}
+
+	return user, nil
+}
+
+func GetGitHubOauthConfig() *oauth2.Config {
+	githubOauthCallbackURL, err := helper.GetStringEnv("GITHUB_OAUTH_CALLBACK_URL")
+	helper.HandleError(err, true, "GITHUB_OAUTH_CALLBACK_URL environment variable not set")
+	githubOauthClientID, err := helper.GetStringEnv("GITHUB_OAUTH_CLIENT_ID")
+	helper.HandleError(err, true, "GITHUB_OAUTH_CLIENT_ID environment variable not set")
+	githubOauthClientSecret, err := helper.GetStringEnv("GITHUB_OAUTH_CLIENT_SECRET")
+	helper.HandleError(err, true, "GITHUB_OAUTH_CLIENT_SECRET environment variable not set")
+
+	return &oauth2.Config{
+		RedirectURL:  githubOauthCallbackURL, // Ex. https://<domain>/auth/github/callback
+		ClientID:     githubOauthClientID,
+		ClientSecret: githubOauthClientSecret,
+		Scopes:       []string{"read:user", "user:email", "read:org"},
+		Endpoint:     github.Endpoint,
+	}
+}
+
+func (p *GitHubProvider) Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error) {
+	token, err := exchange(ctx, p.Config, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}, nil
+}
+
+func (p *GitHubProvider) GetCallbackPath() string {
+	return fmt.Sprintf("/auth/%s/callback", strings.ToLower(p.Name))
+}
+
+func (p *GitHubProvider) GetLoginPath() string {
+	return fmt.Sprintf("/auth/%s/login", strings.ToLower(p.Name))
+}
+
+func (p *GitHubProvider) GetProviderLoginURL(state *session.LoginState) (*url.URL, error) {
+	return authCodeURL(p.Config, state)
+}
+
+// AuthenticateSession accepts the session if no restrictions are configured, or if the user is a
+// member of one of the allowed organizations or teams
+func (p *GitHubProvider) AuthenticateSession(data *session.Data) bool {
+	if !p.AuthenticateEmail(data) {
+		return false
+	}
+	if len(p.Orgs) == 0 && len(p.Teams) == 0 {
+		return true
+	}
+
+	return data.InGroup(p.Orgs...) || data.InGroup(p.Teams...)
+}
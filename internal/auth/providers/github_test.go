@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestGitHubAPI(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	reply := func(v interface{}) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "Bearer access" {
+				res.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(res).Encode(v)
+		}
+	}
+	mux.HandleFunc("/login/oauth/access_token", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write([]byte(`{"access_token":"access","token_type":"bearer"}`))
+	})
+	mux.HandleFunc("/user", reply(map[string]interface{}{"id": 42, "login": "ninja", "name": "Test Ninja", "email": "public@example.com"}))
+	mux.HandleFunc("/user/emails", reply([]githubEmail{
+		{Email: "unverified@example.com", Primary: false, Verified: false},
+		{Email: "ninja@example.com", Primary: true, Verified: true},
+	}))
+	mux.HandleFunc("/user/orgs", reply([]githubOrg{{Login: "habakke"}}))
+	mux.HandleFunc("/user/teams", reply([]githubTeam{{Slug: "ops", Organization: githubOrg{Login: "habakke"}}}))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGitHubGetUser(t *testing.T) {
+	api := newTestGitHubAPI(t)
+	p := NewGitHubProvider(&ProviderData{}, &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{TokenURL: api.URL + "/login/oauth/access_token"},
+	})
+	p.APIURL = api.URL
+
+	require.Equal(t, "/auth/github/login", p.GetLoginPath())
+	token, err := p.Exchange(context.Background(), "code", testLoginState(""))
+	require.NoError(t, err)
+
+	user, err := p.GetUser(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, "42", user.GetID())
+	require.Equal(t, "ninja", user.GetUsername())
+	require.Equal(t, "ninja@example.com", user.GetEmail())
+	require.Equal(t, []string{"habakke", "habakke/ops"}, user.GetGroups())
+}
+
+func TestGitHubAuthenticateSession(t *testing.T) {
+	p := NewGitHubProvider(&ProviderData{}, &oauth2.Config{})
+	s := &session.Data{Groups: []string{"habakke", "habakke/ops"}}
+	require.True(t, p.AuthenticateSession(s))
+
+	p.Orgs = []string{"other"}
+	require.False(t, p.AuthenticateSession(s))
+
+	p.Teams = []string{"Habakke/Ops"}
+	require.True(t, p.AuthenticateSession(s))
+
+	p.Orgs, p.Teams = []string{"habakke"}, nil
+	require.True(t, p.AuthenticateSession(s))
+	require.False(t, p.AuthenticateSession(&session.Data{}))
+}
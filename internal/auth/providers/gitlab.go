@@ -0,0 +1,172 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/habakke/auth-proxy/pkg/helper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gitlabURL = "https://gitlab.com"
+
+type GitLabUserInfo struct {
+	Subject  string   `json:"sub"`
+	Nickname string   `json:"nickname,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Verified bool     `json:"email_verified"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+func (u GitLabUserInfo) GetID() string {
+	return u.Subject
+}
+
+func (u GitLabUserInfo) GetUsername() string {
+	return u.Nickname
+}
+
+func (u GitLabUserInfo) GetName() string {
+	return u.Name
+}
+
+func (u GitLabUserInfo) GetEmail() string {
+	return u.Email
+}
+
+func (u GitLabUserInfo) GetEmailVerified() bool {
+	return u.Verified
+}
+
+func (u GitLabUserInfo) GetGroups() []string {
+	return u.Groups
+}
+
+// GitLabProvider authenticates users with gitlab.com or a self-hosted GitLab instance. Groups are
+// reported by their full path, ex. "my-group/my-subgroup".
+type GitLabProvider struct {
+	*ProviderData
+	Config *oauth2.Config
+
+	// BaseURL is the URL of the GitLab instance
+	BaseURL string
+	// Groups restricts login to members of any of the listed groups or their subgroups
+	Groups []string
+}
+
+func NewGitLabProvider(p *ProviderData, baseURL string, config *oauth2.Config) *GitLabProvider {
+	p.Name = "GitLab"
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  baseURL + "/oauth/authorize",
+		TokenURL: baseURL + "/oauth/token",
+	}
+	return &GitLabProvider{
+		ProviderData: p,
+		Config:       config,
+		BaseURL:      baseURL,
+	}
+}
+
+func (p *GitLabProvider) Data() *ProviderData {
+	return p.ProviderData
+}
+
+func (p *GitLabProvider) GetUser(ctx context.Context, token *Token) (User, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.BaseURL+"/oauth/userinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed read response: %s", err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed getting user info: %s", response.Status)
+	}
+
+	var user = GitLabUserInfo{}
+	if err := json.Unmarshal(data, &user); err != nil {
+		log.Info().AnErr("err", err).Str("data", string(data)).Msg("failed to unmarshal GitLab userinfo")
+		return nil, fmt.Errorf("failed to unmarshal GitLab userinfo")
+	}
+	return user, nil
+}
+
+func GetGitLabOauthConfig() *oauth2.Config {
+	gitlabOauthCallbackURL, err := helper.GetStringEnv("GITLAB_OAUTH_CALLBACK_URL")
+	helper.HandleError(err, true, "GITLAB_OAUTH_CALLBACK_URL environment variable not set")
+	gitlabOauthClientID, err := helper.GetStringEnv("GITLAB_OAUTH_CLIENT_ID")
+	helper.HandleError(err, true, "GITLAB_OAUTH_CLIENT_ID environment variable not set")
+	gitlabOauthClientSecret, err := helper.GetStringEnv("GITLAB_OAUTH_CLIENT_SECRET")
+	helper.HandleError(err, true, "GITLAB_OAUTH_CLIENT_SECRET environment variable not set")
+
+	return &oauth2.Config{
+		RedirectURL:  gitlabOauthCallbackURL, // Ex. https://<domain>/auth/gitlab/callback
+		ClientID:     gitlabOauthClientID,
+		ClientSecret: gitlabOauthClientSecret,
+		Scopes:       []string{"read_user", "openid"},
+	}
+}
+
+func (p *GitLabProvider) Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error) {
+	token, err := exchange(ctx, p.Config, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}, nil
+}
+
+func (p *GitLabProvider) GetCallbackPath() string {
+	return fmt.Sprintf("/auth/%s/callback", strings.ToLower(p.Name))
+}
+
+func (p *GitLabProvider) GetLoginPath() string {
+	return fmt.Sprintf("/auth/%s/login", strings.ToLower(p.Name))
+}
+
+func (p *GitLabProvider) GetProviderLoginURL(state *session.LoginState) (*url.URL, error) {
+	return authCodeURL(p.Config, state)
+}
+
+// AuthenticateSession accepts the session if no groups are configured, or if the user is a member of
+// one of the allowed groups or any of their subgroups
+func (p *GitLabProvider) AuthenticateSession(data *session.Data) bool {
+	if !p.AuthenticateEmail(data) {
+		return false
+	}
+	if len(p.Groups) == 0 {
+		return true
+	}
+
+	for _, g := range data.Groups {
+		for _, allowed := range p.Groups {
+			allowed = strings.Trim(allowed, "/")
+			if strings.EqualFold(g, allowed) || strings.HasPrefix(strings.ToLower(g), strings.ToLower(allowed)+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
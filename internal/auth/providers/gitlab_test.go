@@ -0,0 +1,64 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitLabGetUser(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gitlab/oauth/token", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write([]byte(`{"access_token":"access","token_type":"bearer"}`))
+	})
+	mux.HandleFunc("/gitlab/oauth/userinfo", func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer access" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(res).Encode(GitLabUserInfo{
+			Subject:  "7",
+			Nickname: "ninja",
+			Name:     "Test Ninja",
+			Email:    "ninja@example.com",
+			Verified: true,
+			Groups:   []string{"dev", "ops/platform"},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := NewGitLabProvider(&ProviderData{}, srv.URL+"/gitlab/", &oauth2.Config{ClientID: "client"})
+	require.Equal(t, "/auth/gitlab/login", p.GetLoginPath())
+	require.Equal(t, "/auth/gitlab/callback", p.GetCallbackPath())
+	require.Equal(t, srv.URL+"/gitlab/oauth/authorize", p.Config.Endpoint.AuthURL)
+
+	token, err := p.Exchange(context.Background(), "code", testLoginState(""))
+	require.NoError(t, err)
+	user, err := p.GetUser(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, "7", user.GetID())
+	require.Equal(t, "ninja", user.GetUsername())
+	require.Equal(t, []string{"dev", "ops/platform"}, user.GetGroups())
+}
+
+func TestGitLabAuthenticateSession(t *testing.T) {
+	p := NewGitLabProvider(&ProviderData{}, gitlabURL, &oauth2.Config{})
+	s := &session.Data{Groups: []string{"dev", "ops/platform/team"}}
+	require.True(t, p.AuthenticateSession(s))
+
+	p.Groups = []string{"ops"}
+	require.True(t, p.AuthenticateSession(s))
+
+	p.Groups = []string{"ops/platform"}
+	require.True(t, p.AuthenticateSession(s))
+
+	p.Groups = []string{"op", "ops/plat", "qa"}
+	require.False(t, p.AuthenticateSession(s))
+}
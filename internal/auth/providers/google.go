@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/habakke/auth-proxy/internal/cookie"
 	"github.com/habakke/auth-proxy/internal/session"
 	"github.com/habakke/auth-proxy/pkg/helper"
 	"github.com/rs/zerolog/log"
@@ -45,10 +44,26 @@ func (u GoogleUserInfo) GetEmail() string {
 	return u.Email
 }
 
+func (u GoogleUserInfo) GetEmailVerified() bool {
+	return u.Verified
+}
+
+func (u GoogleUserInfo) GetHostedDomain() string {
+	return u.HD
+}
+
+func (u GoogleUserInfo) GetGroups() []string {
+	return nil
+}
+
 type GoogleProvider struct {
 	*ProviderData
 	Config *oauth2.Config
-	Token  *Token
+
+	// UserInfoURL is the endpoint returning the user info for an access token
+	UserInfoURL string
+	// HostedDomains restricts login to Google Workspace accounts of any of the listed domains
+	HostedDomains []string
 }
 
 func NewGoogleProvider(p *ProviderData, config *oauth2.Config) *GoogleProvider {
@@ -56,6 +71,7 @@ func NewGoogleProvider(p *ProviderData, config *oauth2.Config) *GoogleProvider {
 	return &GoogleProvider{
 		ProviderData: p,
 		Config:       config,
+		UserInfoURL:  oauthGoogleURLAPI,
 	}
 }
 
@@ -63,8 +79,12 @@ func (p *GoogleProvider) Data() *ProviderData {
 	return p.ProviderData
 }
 
-func (p *GoogleProvider) GetUser() (User, error) {
-	response, err := http.Get(oauthGoogleURLAPI + p.Token.AccessToken)
+func (p *GoogleProvider) GetUser(ctx context.Context, token *Token) (User, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.UserInfoURL+url.QueryEscape(token.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
 	}
@@ -101,18 +121,17 @@ func GetGoogleOauthConfig() *oauth2.Config {
 	}
 }
 
-func (p *GoogleProvider) Exchange(code string) error {
-	token, err := p.Config.Exchange(context.Background(), code)
+func (p *GoogleProvider) Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error) {
+	token, err := exchange(ctx, p.Config, code, state)
 	if err != nil {
-		return fmt.Errorf("code exchange failed: %s", err.Error())
+		return nil, err
 	}
 
-	p.Token = &Token{
+	return &Token{
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		Expiry:       token.Expiry,
-	}
-	return nil
+	}, nil
 }
 
 func (p *GoogleProvider) GetCallbackPath() string {
@@ -123,24 +142,22 @@ func (p *GoogleProvider) GetLoginPath() string {
 	return fmt.Sprintf("/auth/%s/login", strings.ToLower(p.Name))
 }
 
-func (p *GoogleProvider) GetProviderLoginURL(res http.ResponseWriter) (*url.URL, error) {
-	nonce, err := cookie.Nonce()
-	if err != nil {
-		log.Error().AnErr("err", err).Msg("failed to generate nonce")
-		return nil, err
+func (p *GoogleProvider) GetProviderLoginURL(state *session.LoginState) (*url.URL, error) {
+	// Google only accepts a single domain hint, which skips the account chooser for that domain
+	if len(p.HostedDomains) == 1 {
+		return authCodeURL(p.Config, state, oauth2.SetAuthURLParam("hd", p.HostedDomains[0]))
 	}
-
-	http.SetCookie(res, cookie.MakeCSRFCookie(nonce))
-	urlString := p.Config.AuthCodeURL(nonce)
-	u, err := url.Parse(urlString)
-	if err != nil {
-		log.Error().AnErr("err", err).Msg("failed to generate an authentication url")
-		return nil, err
-	}
-
-	return u, nil
+	return authCodeURL(p.Config, state)
 }
 
+// AuthenticateSession rejects unverified email addresses, as anyone can create a Google account for any email
+// address, and accounts not matching the hosted domain and email allow lists
 func (p *GoogleProvider) AuthenticateSession(data *session.Data) bool {
-	return true
+	if !data.EmailVerified {
+		return false
+	}
+	if len(p.HostedDomains) > 0 && !containsFold(p.HostedDomains, data.HostedDomain) {
+		return false
+	}
+	return p.AuthenticateEmail(data)
 }
@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestGoogleIdP returns a stub IdP which issues the access token "token-<code>" for each code, and
+// reports the user "user-<code>" as the owner of that token
+func newTestGoogleIdP(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{
+			"access_token": "token-" + req.FormValue("code"),
+			"token_type":   "Bearer",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(res http.ResponseWriter, req *http.Request) {
+		code := strings.TrimPrefix(req.URL.Query().Get("access_token"), "token-")
+		_ = json.NewEncoder(res).Encode(GoogleUserInfo{
+			ID:       "user-" + code,
+			Email:    fmt.Sprintf("user-%s@example.com", code),
+			Verified: true,
+		})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGoogleConcurrentLogins(t *testing.T) {
+	idp := newTestGoogleIdP(t)
+	p := NewGoogleProvider(&ProviderData{}, &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{TokenURL: idp.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	})
+	p.UserInfoURL = idp.URL + "/userinfo?access_token="
+
+	// Every login exchanges its code before any of them fetches the user, so state shared on the
+	// provider would hand out the identity of the last exchange to everyone
+	const logins = 50
+	var exchanged, done sync.WaitGroup
+	exchanged.Add(logins)
+	done.Add(logins)
+	errs := make(chan error, logins)
+	for i := 0; i < logins; i++ {
+		go func(code string) {
+			defer done.Done()
+			token, err := p.Exchange(context.Background(), code, testLoginState(""))
+			exchanged.Done()
+			if err != nil {
+				errs <- err
+				return
+			}
+			exchanged.Wait()
+
+			user, err := p.GetUser(context.Background(), token)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if user.GetID() != "user-"+code {
+				errs <- fmt.Errorf("login with code %s got identity %s", code, user.GetID())
+			}
+		}(fmt.Sprintf("%d", i))
+	}
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestGoogleAuthenticateSession(t *testing.T) {
+	p := NewGoogleProvider(&ProviderData{}, &oauth2.Config{})
+	require.True(t, p.AuthenticateSession(&session.Data{Email: "test@gmail.com", EmailVerified: true}))
+	require.False(t, p.AuthenticateSession(&session.Data{Email: "test@example.com", EmailVerified: false}))
+
+	p.HostedDomains = []string{"example.com"}
+	require.True(t, p.AuthenticateSession(&session.Data{Email: "test@example.com", EmailVerified: true, HostedDomain: "example.com"}))
+	require.False(t, p.AuthenticateSession(&session.Data{Email: "test@gmail.com", EmailVerified: true}))
+
+	u, err := p.GetProviderLoginURL(testLoginState(""))
+	require.NoError(t, err)
+	require.Equal(t, "example.com", u.Query().Get("hd"))
+
+	p.AllowedEmails = []string{"owner@example.com"}
+	require.True(t, p.AuthenticateSession(&session.Data{Email: "owner@example.com", EmailVerified: true, HostedDomain: "example.com"}))
+	require.False(t, p.AuthenticateSession(&session.Data{Email: "test@example.com", EmailVerified: true, HostedDomain: "example.com"}))
+}
@@ -0,0 +1,166 @@
+package providers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/habakke/auth-proxy/pkg/helper"
+	"golang.org/x/oauth2"
+	"net/url"
+	"strings"
+)
+
+type OIDCUserInfo struct {
+	Subject           string   `json:"sub"`
+	Email             string   `json:"email,omitempty"`
+	Verified          bool     `json:"email_verified"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+}
+
+func (u OIDCUserInfo) GetID() string {
+	return u.Subject
+}
+
+func (u OIDCUserInfo) GetUsername() string {
+	if u.PreferredUsername != "" {
+		return u.PreferredUsername
+	}
+	return u.Email
+}
+
+func (u OIDCUserInfo) GetName() string {
+	return u.Name
+}
+
+func (u OIDCUserInfo) GetEmail() string {
+	return u.Email
+}
+
+func (u OIDCUserInfo) GetEmailVerified() bool {
+	return u.Verified
+}
+
+func (u OIDCUserInfo) GetGroups() []string {
+	return u.Groups
+}
+
+// OIDCProvider is a generic OpenID Connect provider configured through discovery
+type OIDCProvider struct {
+	*ProviderData
+	Config   *oauth2.Config
+	Verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider loads the discovery document of the issuer and returns a provider which verifies
+// ID tokens against the keys published by the issuer
+func NewOIDCProvider(p *ProviderData, issuerURL string, config *oauth2.Config) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(context.Background(), issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load discovery document: %s", err.Error())
+	}
+
+	p.Name = "OIDC"
+	config.Endpoint = provider.Endpoint()
+	return &OIDCProvider{
+		ProviderData: p,
+		Config:       config,
+		Verifier:     provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+func (p *OIDCProvider) Data() *ProviderData {
+	return p.ProviderData
+}
+
+// VerifyIDToken checks the signature, issuer, audience and expiry of the ID token, and that the
+// nonce matches the one sent with the authorization request
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*OIDCUserInfo, error) {
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify id_token: %s", err.Error())
+	}
+
+	var user = OIDCUserInfo{}
+	if err := idToken.Claims(&user); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %s", err.Error())
+	}
+
+	if subtle.ConstantTimeCompare([]byte(user.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("id_token nonce does not match")
+	}
+	return &user, nil
+}
+
+// GetUser returns the user in the ID token verified by Exchange
+func (p *OIDCProvider) GetUser(_ context.Context, token *Token) (User, error) {
+	if token == nil {
+		return nil, fmt.Errorf("no id_token available")
+	}
+	user, ok := token.Claims.(OIDCUserInfo)
+	if !ok {
+		return nil, fmt.Errorf("no verified id_token available")
+	}
+	return user, nil
+}
+
+func GetOIDCOauthConfig() *oauth2.Config {
+	oidcCallbackURL, err := helper.GetStringEnv("OIDC_CALLBACK_URL")
+	helper.HandleError(err, true, "OIDC_CALLBACK_URL environment variable not set")
+	oidcClientID, err := helper.GetStringEnv("OIDC_CLIENT_ID")
+	helper.HandleError(err, true, "OIDC_CLIENT_ID environment variable not set")
+	oidcClientSecret, err := helper.GetStringEnv("OIDC_CLIENT_SECRET")
+	helper.HandleError(err, true, "OIDC_CLIENT_SECRET environment variable not set")
+	oidcScopes := helper.GetStringEnvWithDefault("OIDC_SCOPES", "openid,email,profile")
+
+	return &oauth2.Config{
+		RedirectURL:  oidcCallbackURL, // Ex. https://<domain>/auth/oidc/callback
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		Scopes:       strings.Split(oidcScopes, ","),
+	}
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error) {
+	token, err := exchange(ctx, p.Config, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response did not contain an id_token")
+	}
+	user, err := p.VerifyIDToken(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		IDToken:      rawIDToken,
+		Expiry:       token.Expiry,
+		Claims:       *user,
+	}, nil
+}
+
+func (p *OIDCProvider) GetCallbackPath() string {
+	return fmt.Sprintf("/auth/%s/callback", strings.ToLower(p.Name))
+}
+
+func (p *OIDCProvider) GetLoginPath() string {
+	return fmt.Sprintf("/auth/%s/login", strings.ToLower(p.Name))
+}
+
+func (p *OIDCProvider) GetProviderLoginURL(state *session.LoginState) (*url.URL, error) {
+	return authCodeURL(p.Config, state, oidc.Nonce(state.Nonce))
+}
+
+func (p *OIDCProvider) AuthenticateSession(data *session.Data) bool {
+	return p.AuthenticateEmail(data)
+}
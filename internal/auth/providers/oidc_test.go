@@ -0,0 +1,188 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "auth-proxy"
+	testNonce    = "0123456789abcdef"
+)
+
+// testIssuer is a minimal OpenID Connect issuer serving discovery, JWKS and a token endpoint
+type testIssuer struct {
+	*httptest.Server
+	key          *rsa.PrivateKey
+	idToken      string
+	codeVerifier string
+}
+
+func testLoginState(nonce string) *session.LoginState {
+	return &session.LoginState{State: "state", Nonce: nonce, CodeVerifier: oauth2.GenerateVerifier()}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(res http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(res http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(res).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		issuer.codeVerifier = req.FormValue("code_verifier")
+		res.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(res).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken,
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	require.NoError(t, err)
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+	return raw
+}
+
+func (i *testIssuer) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                i.URL,
+		"aud":                testClientID,
+		"sub":                "1234",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              testNonce,
+		"email":              "ninja@example.com",
+		"email_verified":     true,
+		"name":               "Test Ninja",
+		"preferred_username": "ninja",
+	}
+}
+
+func newTestOIDCProvider(t *testing.T, issuer *testIssuer) *OIDCProvider {
+	p, err := NewOIDCProvider(&ProviderData{}, issuer.URL, &oauth2.Config{
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/oidc/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p := newTestOIDCProvider(t, issuer)
+
+	require.Equal(t, issuer.URL+"/token", p.Config.Endpoint.TokenURL)
+	require.Equal(t, "/auth/oidc/login", p.GetLoginPath())
+	require.Equal(t, "/auth/oidc/callback", p.GetCallbackPath())
+
+	state := testLoginState(testNonce)
+	u, err := p.GetProviderLoginURL(state)
+	require.NoError(t, err)
+	require.Equal(t, issuer.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, state.State, u.Query().Get("state"))
+	require.Equal(t, state.Nonce, u.Query().Get("nonce"))
+	require.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	require.Equal(t, oauth2.S256ChallengeFromVerifier(state.CodeVerifier), u.Query().Get("code_challenge"))
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p := newTestOIDCProvider(t, issuer)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		mutate func(claims map[string]interface{})
+		nonce  string
+		valid  bool
+	}{
+		{name: "valid", key: issuer.key, nonce: testNonce, valid: true},
+		{name: "wrong nonce", key: issuer.key, nonce: "other", valid: false},
+		{name: "wrong signature", key: otherKey, nonce: testNonce, valid: false},
+		{name: "wrong issuer", key: issuer.key, nonce: testNonce, valid: false,
+			mutate: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{name: "wrong audience", key: issuer.key, nonce: testNonce, valid: false,
+			mutate: func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{name: "expired", key: issuer.key, nonce: testNonce, valid: false,
+			mutate: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.claims()
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			user, err := p.VerifyIDToken(context.Background(), signTestToken(t, tt.key, claims), tt.nonce)
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "1234", user.GetID())
+			require.Equal(t, "ninja", user.GetUsername())
+			require.Equal(t, "Test Ninja", user.GetName())
+			require.Equal(t, "ninja@example.com", user.GetEmail())
+		})
+	}
+}
+
+func TestOIDCExchangeAndGetUser(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.idToken = signTestToken(t, issuer.key, issuer.claims())
+	p := newTestOIDCProvider(t, issuer)
+
+	_, err := p.Exchange(context.Background(), "code", testLoginState("other"))
+	require.Error(t, err)
+	state := testLoginState(testNonce)
+	token, err := p.Exchange(context.Background(), "code", state)
+	require.NoError(t, err)
+	require.Equal(t, state.CodeVerifier, issuer.codeVerifier)
+
+	user, err := p.GetUser(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, "1234", user.GetID())
+	require.Equal(t, "ninja@example.com", user.GetEmail())
+
+	// Only the ID token verified by the exchange is trusted
+	_, err = p.GetUser(context.Background(), &Token{IDToken: token.IDToken})
+	require.Error(t, err)
+}
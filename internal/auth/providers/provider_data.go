@@ -1,5 +1,50 @@
 package providers
 
+import (
+	"github.com/habakke/auth-proxy/internal/session"
+	"strings"
+)
+
 type ProviderData struct {
 	Name string
+	// DisplayName is shown on the login page instead of the name when set
+	DisplayName string
+	// AllowedEmails restricts login to users with any of the listed email addresses
+	AllowedEmails []string
+	// AllowedDomains restricts login to users with an email address in any of the listed domains
+	AllowedDomains []string
+}
+
+func (p *ProviderData) GetDisplayName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Name
+}
+
+// containsFold returns true if the list contains the value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateEmail returns true if the verified email address of the session is allowed by the allow lists.
+// Both lists allow any email address when neither is set.
+func (p *ProviderData) AuthenticateEmail(data *session.Data) bool {
+	if len(p.AllowedEmails) == 0 && len(p.AllowedDomains) == 0 {
+		return true
+	}
+	if !data.EmailVerified {
+		return false
+	}
+
+	if containsFold(p.AllowedEmails, data.Email) {
+		return true
+	}
+	at := strings.LastIndex(data.Email, "@")
+	return at >= 0 && containsFold(p.AllowedDomains, data.Email[at+1:])
 }
@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAuthenticateEmail(t *testing.T) {
+	p := &ProviderData{}
+	require.True(t, p.AuthenticateEmail(&session.Data{Email: "test@example.com"}))
+
+	p.AllowedEmails = []string{"owner@other.com"}
+	p.AllowedDomains = []string{"example.com"}
+	for _, tt := range []struct {
+		data    session.Data
+		allowed bool
+	}{
+		{data: session.Data{Email: "test@Example.com", EmailVerified: true}, allowed: true},
+		{data: session.Data{Email: "Owner@other.com", EmailVerified: true}, allowed: true},
+		{data: session.Data{Email: "test@example.com", EmailVerified: false}, allowed: false},
+		{data: session.Data{Email: "test@other.com", EmailVerified: true}, allowed: false},
+		{data: session.Data{Email: "test@sub.example.com", EmailVerified: true}, allowed: false},
+		{data: session.Data{Email: "example.com", EmailVerified: true}, allowed: false},
+	} {
+		require.Equal(t, tt.allowed, p.AuthenticateEmail(&tt.data), tt.data.Email)
+	}
+}
@@ -1,19 +1,28 @@
 package providers
 
 import (
+	"context"
+	"fmt"
 	"github.com/habakke/auth-proxy/internal/session"
-	"net/http"
+	"github.com/habakke/auth-proxy/pkg/helper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
 	"net/url"
+	"strings"
 	"time"
 )
 
 type Provider interface {
 	Data() *ProviderData
-	GetUser() (User, error)
-	Exchange(code string) error
+	// GetUser returns the user the token was issued to
+	GetUser(ctx context.Context, token *Token) (User, error)
+	// Exchange trades the authorization code for a token. The login state holds the values sent with
+	// the authorization request, and providers issuing ID tokens must verify the nonce. Providers must
+	// not keep any per-user state, as they are shared between concurrent logins.
+	Exchange(ctx context.Context, code string, state *session.LoginState) (*Token, error)
 	GetLoginPath() string
 	GetCallbackPath() string
-	GetProviderLoginURL(res http.ResponseWriter) (*url.URL, error)
+	GetProviderLoginURL(state *session.LoginState) (*url.URL, error)
 
 	AuthenticateSession(data *session.Data) bool
 }
@@ -23,19 +32,78 @@ type User interface {
 	GetUsername() string
 	GetName() string
 	GetEmail() string
+	// GetEmailVerified returns true if the provider has verified that the email address belongs to the user
+	GetEmailVerified() bool
+	GetGroups() []string
+}
+
+// HostedDomainUser is implemented by users of providers reporting the organization domain managing the account
+type HostedDomainUser interface {
+	GetHostedDomain() string
 }
 
 type Token struct {
 	AccessToken  string
 	RefreshToken string
+	IDToken      string
 	Expiry       time.Time
+	// Claims is the user in the ID token, set by providers which verify it when exchanging the code
+	Claims User
 }
 
 func New(provider string, p *ProviderData) Provider {
-	switch provider {
+	switch strings.ToLower(provider) {
+	case "oidc":
+		issuerURL, err := helper.GetStringEnv("OIDC_ISSUER_URL")
+		helper.HandleError(err, true, "OIDC_ISSUER_URL environment variable not set")
+		p.DisplayName = helper.GetStringEnvWithDefault("OIDC_DISPLAY_NAME", "")
+		o, err := NewOIDCProvider(p, issuerURL, GetOIDCOauthConfig())
+		helper.HandleError(err, true, "failed to configure OIDC provider %s", issuerURL)
+		return o
+	case "github":
+		g := NewGitHubProvider(p, GetGitHubOauthConfig())
+		g.APIURL = helper.GetStringEnvWithDefault("GITHUB_API_URL", githubAPIURL)
+		g.Orgs = helper.GetStringListEnv("GITHUB_ORGS")
+		g.Teams = helper.GetStringListEnv("GITHUB_TEAMS")
+		return g
+	case "gitlab":
+		g := NewGitLabProvider(p, helper.GetStringEnvWithDefault("GITLAB_URL", gitlabURL), GetGitLabOauthConfig())
+		g.Groups = helper.GetStringListEnv("GITLAB_GROUPS")
+		return g
+	case "azure":
+		a := NewAzureProvider(p,
+			helper.GetStringEnvWithDefault("AZURE_AUTHORITY_URL", azureAuthorityURL),
+			helper.GetStringEnvWithDefault("AZURE_TENANT", "common"),
+			GetAzureOauthConfig())
+		a.GraphURL = helper.GetStringEnvWithDefault("AZURE_GRAPH_URL", azureGraphURL)
+		a.AllowedTenants = helper.GetStringListEnv("AZURE_ALLOWED_TENANTS")
+		a.Groups = helper.GetStringListEnv("AZURE_GROUPS")
+		return a
 	case "google":
-		return NewGoogleProvider(p, GetGoogleOauthConfig())
+		g := NewGoogleProvider(p, GetGoogleOauthConfig())
+		g.HostedDomains = helper.GetStringListEnv("GOOGLE_HOSTED_DOMAINS")
+		return g
 	default:
 		return NewGoogleProvider(p, GetGoogleOauthConfig())
 	}
 }
+
+// authCodeURL returns the authorization request URL carrying the CSRF state and the PKCE code challenge
+func authCodeURL(config *oauth2.Config, state *session.LoginState, opts ...oauth2.AuthCodeOption) (*url.URL, error) {
+	opts = append(opts, oauth2.S256ChallengeOption(state.CodeVerifier))
+	u, err := url.Parse(config.AuthCodeURL(state.State, opts...))
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to generate an authentication url")
+		return nil, err
+	}
+	return u, nil
+}
+
+// exchange trades the authorization code for a token, proving possession of the PKCE code verifier
+func exchange(ctx context.Context, config *oauth2.Config, code string, state *session.LoginState) (*oauth2.Token, error) {
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(state.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %s", err.Error())
+	}
+	return token, nil
+}
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //#nosec
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TOTPDigits and TOTPPeriod are the defaults of authenticator apps, which ignore other values
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+	// totpSkew is the number of periods before and after the current one accepted, for clock drift
+	totpSkew = 1
+
+	// RecoveryCodeCount is the number of recovery codes issued on enrolment, each usable once
+	RecoveryCodeCount = 10
+	// MaxSecondFactorFailures is the number of wrong codes in a row after which the second factor of the user is
+	// locked for SecondFactorLockout, so the codes can not be guessed
+	MaxSecondFactorFailures = 5
+	SecondFactorLockout     = 5 * time.Minute
+)
+
+var ErrSecondFactorLocked = errors.New("second factor is locked after too many invalid codes")
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random secret of 160 bits, base32 encoded as in otpauth URIs
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return base32NoPadding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp returns the HOTP value of the counter, as in RFC 4226
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// TOTPCode returns the code of the secret at the time, as shown by authenticator apps
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(totpCounter(t)), TOTPDigits), nil
+}
+
+// validateTOTP checks the code against the periods around the time, and returns the counter of the matching
+// period. Codes of periods up to the last used counter are rejected, so a code can only be used once.
+func validateTOTP(secret string, code string, t time.Time, lastCounter int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	now := totpCounter(t)
+	for c := now - totpSkew; c <= now+totpSkew; c++ {
+		if c <= lastCounter || c < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(c), TOTPDigits)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI returns the otpauth URI of the secret, which authenticator apps read from the QR code
+func TOTPURI(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// newRecoveryCodes returns random recovery codes, formatted as xxxxx-xxxxx, and their hashes
+func newRecoveryCodes(n int) (codes []string, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes = append(codes, c[:5]+"-"+c[5:])
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code, ignoring case, spaces and dashes. The codes have 50 bits of
+// entropy and can only be tried a few times per login, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTP enrols users in and verifies the TOTP second factor, with the secrets kept in the store
+type TOTP struct {
+	// mu serializes updates, so a code or recovery code can not be used twice by concurrent requests
+	mu     sync.Mutex
+	store  TOTPStore
+	issuer string
+}
+
+func NewTOTP(store TOTPStore, issuer string) *TOTP {
+	return &TOTP{store: store, issuer: issuer}
+}
+
+// Issuer returns the name the accounts are shown with in authenticator apps
+func (t *TOTP) Issuer() string {
+	return t.issuer
+}
+
+// Enrolment returns the enrolment of the user, and starts a new unconfirmed enrolment if the user has none
+func (t *TOTP) Enrolment(userKey string) (*TOTPEnrolment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, err := t.store.Get(userKey)
+	if err == nil {
+		return e, nil
+	}
+	if !errors.Is(err, ErrNotEnrolled) {
+		return nil, err
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	e = &TOTPEnrolment{UserKey: userKey, Secret: secret}
+	if err = t.store.Put(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Confirm completes the enrolment of the user with the first code from the authenticator app, and returns the
+// recovery codes. They are only stored hashed, so they must be shown to the user now.
+func (t *TOTP) Confirm(userKey string, code string) ([]string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, err := t.store.Get(userKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if e.Confirmed {
+		return nil, false, fmt.Errorf("totp is already enrolled")
+	}
+	if e.locked(time.Now()) {
+		return nil, false, ErrSecondFactorLocked
+	}
+	counter, ok := validateTOTP(e.Secret, strings.TrimSpace(code), time.Now(), e.LastCounter)
+	if !ok {
+		return nil, false, t.failed(e)
+	}
+
+	codes, hashes, err := newRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, false, err
+	}
+	e.Confirmed = true
+	e.Failures = 0
+	e.LastCounter = counter
+	e.RecoveryCodes = hashes
+	e.EnrolledAt = time.Now().UTC()
+	if err = t.store.Put(e); err != nil {
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+// Verify checks a code from the authenticator app, or one of the unused recovery codes of the user
+func (t *TOTP) Verify(userKey string, code string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, err := t.store.Get(userKey)
+	if err != nil {
+		return false, err
+	}
+	if !e.Confirmed {
+		return false, nil
+	}
+	if e.locked(time.Now()) {
+		return false, ErrSecondFactorLocked
+	}
+
+	code = strings.TrimSpace(code)
+	if counter, ok := validateTOTP(e.Secret, code, time.Now(), e.LastCounter); ok {
+		e.LastCounter = counter
+		e.Failures = 0
+		return true, t.store.Put(e)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range e.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			e.Failures = 0
+			return true, t.store.Put(e)
+		}
+	}
+	return false, t.failed(e)
+}
+
+// failed records an invalid code, and locks the second factor after too many in a row
+func (t *TOTP) failed(e *TOTPEnrolment) error {
+	e.Failures++
+	if e.Failures >= MaxSecondFactorFailures {
+		e.Failures = 0
+		e.LockedUntil = time.Now().Add(SecondFactorLockout).UTC()
+	}
+	return t.store.Put(e)
+}
+
+// Reset removes the enrolment of the user, who enrols again on the next login
+func (t *TOTP) Reset(userKey string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.store.Delete(userKey)
+}
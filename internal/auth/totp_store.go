@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotEnrolled = errors.New("user is not enrolled in totp")
+
+// TOTPEnrolment is the TOTP secret of a user and the state of its second factor
+type TOTPEnrolment struct {
+	UserKey string `json:"user_key"`
+	Secret  string `json:"secret"`
+	// Confirmed is set once the user has entered a code from the authenticator app
+	Confirmed bool `json:"confirmed"`
+	// LastCounter is the time step of the last code used, so codes can not be replayed
+	LastCounter int64 `json:"last_counter"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"`
+	EnrolledAt    time.Time `json:"enrolled_at"`
+	// Failures counts the invalid codes entered since the last valid one
+	Failures    int       `json:"failures,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+func (e *TOTPEnrolment) locked(now time.Time) bool {
+	return now.Before(e.LockedUntil)
+}
+
+// TOTPStore keeps the TOTP secrets of the local users
+type TOTPStore interface {
+	// Get returns the enrolment of the user, or ErrNotEnrolled
+	Get(userKey string) (*TOTPEnrolment, error)
+	Put(e *TOTPEnrolment) error
+	Delete(userKey string) error
+	Close() error
+}
+
+// TOTPUserKey returns the key of the enrolment of a user of the login form backend
+func TOTPUserKey(provider string, userID string) string {
+	return strings.ToLower(provider) + ":" + userID
+}
+
+// MemoryTOTPStore keeps the TOTP secrets in memory, so users have to enrol again after a restart
+type MemoryTOTPStore struct {
+	mu         sync.Mutex
+	enrolments map[string]TOTPEnrolment
+}
+
+func NewMemoryTOTPStore() *MemoryTOTPStore {
+	return &MemoryTOTPStore{enrolments: make(map[string]TOTPEnrolment)}
+}
+
+func (s *MemoryTOTPStore) Get(userKey string) (*TOTPEnrolment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrolments[userKey]
+	if !ok {
+		return nil, ErrNotEnrolled
+	}
+	e.RecoveryCodes = append([]string(nil), e.RecoveryCodes...)
+	return &e, nil
+}
+
+func (s *MemoryTOTPStore) Put(e *TOTPEnrolment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *e
+	stored.RecoveryCodes = append([]string(nil), e.RecoveryCodes...)
+	s.enrolments[e.UserKey] = stored
+	return nil
+}
+
+func (s *MemoryTOTPStore) Delete(userKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.enrolments, userKey)
+	return nil
+}
+
+func (s *MemoryTOTPStore) Close() error {
+	return nil
+}
+
+var totpBucket = []byte("totp")
+
+// BoltTOTPStore keeps the TOTP secrets in a local BoltDB file
+type BoltTOTPStore struct {
+	db *bolt.DB
+}
+
+func NewBoltTOTPStore(path string) (*BoltTOTPStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open totp database: %s", err.Error())
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(totpBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize totp database: %s", err.Error())
+	}
+
+	return &BoltTOTPStore{db: db}, nil
+}
+
+func (s *BoltTOTPStore) Get(userKey string) (*TOTPEnrolment, error) {
+	e := &TOTPEnrolment{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(totpBucket).Get([]byte(userKey))
+		if v == nil {
+			return ErrNotEnrolled
+		}
+		return json.Unmarshal(v, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *BoltTOTPStore) Put(e *TOTPEnrolment) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(totpBucket).Put([]byte(e.UserKey), v)
+	})
+}
+
+func (s *BoltTOTPStore) Delete(userKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(totpBucket).Delete([]byte(userKey))
+	})
+}
+
+func (s *BoltTOTPStore) Close() error {
+	return s.db.Close()
+}
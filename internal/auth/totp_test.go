@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 6238 for SHA1
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for ts, code := range vectors {
+		require.Equal(t, code, hotp(key, uint64(totpCounter(time.Unix(ts, 0))), 8), "time %d", ts)
+	}
+
+	secret := base32.StdEncoding.EncodeToString(key)
+	code, err := TOTPCode(secret, time.Unix(59, 0))
+	require.NoError(t, err)
+	require.Equal(t, "287082", code)
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	for _, offset := range []time.Duration{-TOTPPeriod, 0, TOTPPeriod} {
+		code, err := TOTPCode(secret, now.Add(offset))
+		require.NoError(t, err)
+		_, ok := validateTOTP(secret, code, now, 0)
+		require.True(t, ok)
+	}
+	code, err := TOTPCode(secret, now.Add(-3*TOTPPeriod))
+	require.NoError(t, err)
+	_, ok := validateTOTP(secret, code, now, 0)
+	require.False(t, ok)
+
+	// codes can not be used twice
+	code, err = TOTPCode(secret, now)
+	require.NoError(t, err)
+	counter, ok := validateTOTP(secret, code, now, 0)
+	require.True(t, ok)
+	_, ok = validateTOTP(secret, code, now, counter)
+	require.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("Example Corp", "alice@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/Example Corp:alice@example.com", u.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	require.Equal(t, "Example Corp", u.Query().Get("issuer"))
+}
+
+func TestTOTP(t *testing.T) {
+	stores := map[string]TOTPStore{
+		"memory": NewMemoryTOTPStore(),
+	}
+	bolt, err := NewBoltTOTPStore(filepath.Join(t.TempDir(), "totp.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	stores["bolt"] = bolt
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			totp := NewTOTP(store, "auth-proxy")
+			key := TOTPUserKey(LocalProviderName, "alice")
+
+			// the enrolment is kept until it is confirmed
+			e, err := totp.Enrolment(key)
+			require.NoError(t, err)
+			require.False(t, e.Confirmed)
+			again, err := totp.Enrolment(key)
+			require.NoError(t, err)
+			require.Equal(t, e.Secret, again.Secret)
+
+			ok, err := totp.Verify(key, "000000")
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			_, ok, err = totp.Confirm(key, "000000")
+			require.NoError(t, err)
+			require.False(t, ok)
+			code, err := TOTPCode(e.Secret, time.Now())
+			require.NoError(t, err)
+			codes, ok, err := totp.Confirm(key, code)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Len(t, codes, RecoveryCodeCount)
+
+			// the code used to confirm the enrolment can not be used again
+			ok, err = totp.Verify(key, code)
+			require.NoError(t, err)
+			require.False(t, ok)
+			code, err = TOTPCode(e.Secret, time.Now().Add(TOTPPeriod))
+			require.NoError(t, err)
+			ok, err = totp.Verify(key, code)
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			// recovery codes can be used once
+			ok, err = totp.Verify(key, strings.ToUpper(codes[0]))
+			require.NoError(t, err)
+			require.True(t, ok)
+			ok, err = totp.Verify(key, codes[0])
+			require.NoError(t, err)
+			require.False(t, ok)
+			e, err = store.Get(key)
+			require.NoError(t, err)
+			require.Len(t, e.RecoveryCodes, RecoveryCodeCount-1)
+
+			// the second factor is locked after too many invalid codes, counting the reused recovery code
+			for i := 1; i < MaxSecondFactorFailures; i++ {
+				ok, err = totp.Verify(key, "000000")
+				require.NoError(t, err)
+				require.False(t, ok)
+			}
+			ok, err = totp.Verify(key, codes[1])
+			require.ErrorIs(t, err, ErrSecondFactorLocked)
+			require.False(t, ok)
+
+			require.NoError(t, totp.Reset(key))
+			_, err = store.Get(key)
+			require.ErrorIs(t, err, ErrNotEnrolled)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package cookie
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// formatV2 prefixes cookie values sealed with AES-GCM. Values without a version prefix are in the legacy format,
+// encrypted with AES-CFB and signed with an HMAC by SignCookieValue.
+const formatV2 = "v2."
+
+// aeadKeyInfo binds the derived key to its use, so the same secret never keys two different algorithms
+const aeadKeyInfo = "auth-proxy cookie v2"
+
+var ErrInvalidCookie = errors.New("invalid cookie")
+
+// AEAD seals cookie values with AES-256-GCM, authenticating the cookie name as associated data so a value can not
+// be moved to another cookie. The time the value was sealed is part of the encrypted payload.
+type AEAD struct {
+	aead cipher.AEAD
+}
+
+// NewAEAD derives the AES-256-GCM key from the secret with HKDF-SHA256
+func NewAEAD(secret string) (*AEAD, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("cookie secret must be at least 16 bytes, but is only %d bytes", len(secret))
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(aeadKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AEAD{aead: aead}, nil
+}
+
+// IsVersioned returns true if the cookie value is in a versioned format, rather than the legacy format
+func IsVersioned(value string) bool {
+	return strings.HasPrefix(value, formatV2)
+}
+
+// Seal returns the cookie value holding the encrypted value, sealed at the time now
+func (a *AEAD) Seal(name string, value string, now time.Time) (string, error) {
+	nonce := make([]byte, a.aead.NonceSize(), a.aead.NonceSize()+8+len(value)+a.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce: %s", err.Error())
+	}
+
+	plaintext := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(plaintext, uint64(now.Unix()))
+	plaintext = append(plaintext, value...)
+
+	sealed := a.aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return formatV2 + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts and authenticates the cookie, and returns the value if it was sealed within the expiration
+func (a *AEAD) Open(c *http.Cookie, expiration time.Duration) (value string, t time.Time, err error) {
+	if !IsVersioned(c.Value) {
+		return "", t, ErrInvalidCookie
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(c.Value, formatV2))
+	if err != nil || len(sealed) < a.aead.NonceSize() {
+		return "", t, ErrInvalidCookie
+	}
+
+	nonce := sealed[:a.aead.NonceSize()]
+	plaintext, err := a.aead.Open(nil, nonce, sealed[a.aead.NonceSize():], []byte(c.Name))
+	if err != nil || len(plaintext) < 8 {
+		return "", t, ErrInvalidCookie
+	}
+
+	t = time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if !t.After(time.Now().Add(-expiration)) || !t.Before(time.Now().Add(time.Minute*5)) {
+		return "", t, fmt.Errorf("cookie has expired")
+	}
+	return string(plaintext[8:]), t, nil
+}
+
+// Keyring seals cookie values with its primary key, and opens values sealed with any of its keys, so keys can be
+// rotated without invalidating the cookies already issued
+type Keyring struct {
+	keys []*AEAD
+}
+
+// NewKeyring returns a keyring of the secrets, where the first secret is the primary key
+func NewKeyring(secrets ...string) (*Keyring, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("at least one cookie secret is required")
+	}
+
+	k := &Keyring{}
+	for i, secret := range secrets {
+		a, err := NewAEAD(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie secret %d: %s", i, err.Error())
+		}
+		k.keys = append(k.keys, a)
+	}
+	return k, nil
+}
+
+// Seal returns the cookie value holding the value sealed with the primary key
+func (k *Keyring) Seal(name string, value string, now time.Time) (string, error) {
+	return k.keys[0].Seal(name, value, now)
+}
+
+// Open tries each key in order, and returns the value and whether it was sealed with the primary key
+func (k *Keyring) Open(c *http.Cookie, expiration time.Duration) (value string, t time.Time, primary bool, err error) {
+	for i, key := range k.keys {
+		value, t, err = key.Open(c, expiration)
+		if !errors.Is(err, ErrInvalidCookie) {
+			return value, t, i == 0 && err == nil, err
+		}
+	}
+	return "", t, false, err
+}
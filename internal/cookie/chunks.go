@@ -0,0 +1,68 @@
+package cookie
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxCookieSize is the largest name and value of a cookie, below the 4096 bytes all browsers accept
+const MaxCookieSize = 4000
+
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s_%d", name, i)
+}
+
+// isChunkOf returns true if the cookie name is the name of a chunk of the named cookie
+func isChunkOf(chunk string, name string) bool {
+	suffix, ok := strings.CutPrefix(chunk, name+"_")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil
+}
+
+// SplitCookie splits a cookie too large for browsers into chunks named name_0, name_1, ... with the attributes of
+// the cookie. Cookies small enough are returned as they are.
+func SplitCookie(c *http.Cookie) []*http.Cookie {
+	if len(c.Name)+len(c.Value) <= MaxCookieSize {
+		return []*http.Cookie{c}
+	}
+
+	var chunks []*http.Cookie
+	for i, value := 0, c.Value; len(value) > 0; i++ {
+		name := chunkName(c.Name, i)
+		size := MaxCookieSize - len(name)
+		if size > len(value) {
+			size = len(value)
+		}
+		chunk := *c
+		chunk.Name = name
+		chunk.Value = value[:size]
+		chunks = append(chunks, &chunk)
+		value = value[size:]
+	}
+	return chunks
+}
+
+// JoinCookies returns the named cookie of the request, putting it back together from its chunks if it was split
+func JoinCookies(req *http.Request, name string) (*http.Cookie, error) {
+	if c, err := req.Cookie(name); err == nil {
+		return c, nil
+	}
+
+	var value strings.Builder
+	for i := 0; ; i++ {
+		chunk, err := req.Cookie(chunkName(name, i))
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("cookie %q not present", name)
+			}
+			break
+		}
+		value.WriteString(chunk.Value)
+	}
+	return &http.Cookie{Name: name, Value: value.String()}, nil
+}
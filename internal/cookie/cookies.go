@@ -19,33 +19,6 @@ import (
 
 const CSRFCookieName = "csrf_state"
 
-func MakeCookie(name string, value string) *http.Cookie {
-	c := &http.Cookie{
-		Name:     name,
-		Value:    value,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		MaxAge:   86400,
-	}
-
-	return c
-}
-
-func MakeInvalidationCookie(name string) *http.Cookie {
-	c := &http.Cookie{
-		Name:   name,
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	}
-	return c
-}
-
-func MakeCSRFCookie(nonce string) *http.Cookie {
-	return MakeCookie(CSRFCookieName, nonce)
-}
-
 // cookies are stored in a 3 part (value + timestamp + signature) to enforce that the values are as originally set.
 // additionally, the 'value' is encrypted so it's opaque to the browser
 
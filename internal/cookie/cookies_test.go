@@ -2,8 +2,11 @@ package cookie
 
 import (
 	"encoding/base64"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -90,3 +93,161 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestAEAD(t *testing.T) {
+	a, err := NewAEAD("2345asdYDS!2012L")
+	assert.NoError(t, err)
+	_, err = NewAEAD("short")
+	assert.Error(t, err)
+
+	v1, err := a.Seal("session", "payload", time.Now())
+	assert.NoError(t, err)
+	v2, err := a.Seal("session", "payload", time.Now())
+	assert.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+	assert.True(t, IsVersioned(v1))
+	assert.NotContains(t, v1, "payload")
+
+	value, _, err := a.Open(&http.Cookie{Name: "session", Value: v1}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", value)
+
+	// The cookie name is authenticated
+	_, _, err = a.Open(&http.Cookie{Name: "csrf_state", Value: v1}, time.Hour)
+	assert.Error(t, err)
+
+	// Tampered values are rejected
+	tampered := []byte(v1)
+	tampered[len(tampered)-2] ^= 1
+	_, _, err = a.Open(&http.Cookie{Name: "session", Value: string(tampered)}, time.Hour)
+	assert.Error(t, err)
+
+	// Values sealed with another key are rejected
+	other, _ := NewAEAD("0123456789abcdefghijklmnopqrstuv")
+	_, _, err = other.Open(&http.Cookie{Name: "session", Value: v1}, time.Hour)
+	assert.Error(t, err)
+
+	// Expired values are rejected
+	old, _ := a.Seal("session", "payload", time.Now().Add(-2*time.Hour))
+	_, _, err = a.Open(&http.Cookie{Name: "session", Value: old}, time.Hour)
+	assert.Error(t, err)
+
+	// Legacy values are not versioned
+	assert.False(t, IsVersioned(SignCookieValue("seed", "session", "payload", time.Now())))
+}
+
+func TestKeyring(t *testing.T) {
+	_, err := NewKeyring()
+	assert.Error(t, err)
+	_, err = NewKeyring("2345asdYDS!2012L", "short")
+	assert.Error(t, err)
+
+	old, err := NewKeyring("2345asdYDS!2012L")
+	assert.NoError(t, err)
+	v, err := old.Seal("session", "payload", time.Now())
+	assert.NoError(t, err)
+
+	// Adding a key keeps the cookies of the primary key valid
+	added, err := NewKeyring("2345asdYDS!2012L", "0123456789abcdefghijklmnopqrstuv")
+	assert.NoError(t, err)
+	value, _, primary, err := added.Open(&http.Cookie{Name: "session", Value: v}, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, primary)
+	assert.Equal(t, "payload", value)
+
+	// Promoting the new key keeps the cookies of the old key valid, but no longer primary
+	promoted, err := NewKeyring("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	assert.NoError(t, err)
+	value, _, primary, err = promoted.Open(&http.Cookie{Name: "session", Value: v}, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, primary)
+	assert.Equal(t, "payload", value)
+
+	// Retiring the old key invalidates its cookies
+	retired, err := NewKeyring("0123456789abcdefghijklmnopqrstuv")
+	assert.NoError(t, err)
+	_, _, _, err = retired.Open(&http.Cookie{Name: "session", Value: v}, time.Hour)
+	assert.Error(t, err)
+
+	// Expired cookies are not retried with the other keys
+	v, _ = promoted.Seal("session", "payload", time.Now().Add(-2*time.Hour))
+	_, _, _, err = promoted.Open(&http.Cookie{Name: "session", Value: v}, time.Hour)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidCookie)
+}
+
+func TestSplitAndJoinCookies(t *testing.T) {
+	p := DefaultPolicy()
+	small := p.MakeCookie("session", "value", time.Hour)
+	assert.Equal(t, []*http.Cookie{small}, SplitCookie(small))
+
+	large := p.MakeCookie("session", strings.Repeat("0123456789", 1000), time.Hour)
+	chunks := SplitCookie(large)
+	assert.Len(t, chunks, 3)
+	req := httptest.NewRequest("GET", "/", nil)
+	for i, c := range chunks {
+		assert.Equal(t, fmt.Sprintf("session_%d", i), c.Name)
+		assert.LessOrEqual(t, len(c.Name)+len(c.Value), MaxCookieSize)
+		assert.Equal(t, large.MaxAge, c.MaxAge)
+		req.AddCookie(c)
+	}
+	req.AddCookie(&http.Cookie{Name: "session_other", Value: "other"})
+
+	joined, err := JoinCookies(req, "session")
+	assert.NoError(t, err)
+	assert.Equal(t, large.Value, joined.Value)
+	_, err = JoinCookies(req, "csrf_state")
+	assert.Error(t, err)
+
+	// Setting the cookie unsplit clears all chunks
+	stale := p.StaleCookies(req, "session", []*http.Cookie{small})
+	assert.Len(t, stale, 3)
+	for _, c := range stale {
+		assert.Equal(t, -1, c.MaxAge)
+		assert.NotEqual(t, "session_other", c.Name)
+	}
+	assert.Empty(t, p.StaleCookies(req, "session", chunks))
+}
+
+func TestPolicy(t *testing.T) {
+	p := DefaultPolicy()
+	assert.NoError(t, p.Validate())
+	c := p.MakeCookie("session", "value", time.Hour)
+	assert.Equal(t, "session", c.Name)
+	assert.Equal(t, "/", c.Path)
+	assert.Empty(t, c.Domain)
+	assert.True(t, c.Secure)
+	assert.True(t, c.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	assert.Equal(t, 3600, c.MaxAge)
+
+	p.Prefix = HostPrefix
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, "__Host-session", p.MakeCookie("session", "value", time.Hour).Name)
+	assert.Equal(t, "__Host-session", p.MakeInvalidationCookie("session").Name)
+	p.Domain = "example.com"
+	assert.Error(t, p.Validate())
+
+	p.Prefix = SecurePrefix
+	assert.NoError(t, p.Validate())
+	c = p.MakeCookie("session", "value", time.Hour)
+	assert.Equal(t, "__Secure-session", c.Name)
+	assert.Equal(t, "example.com", c.Domain)
+	p.Secure = false
+	assert.Error(t, p.Validate())
+
+	p.Prefix = ""
+	assert.NoError(t, p.Validate())
+	p.SameSite = http.SameSiteNoneMode
+	assert.Error(t, p.Validate())
+	p.Prefix = "__Other-"
+	assert.Error(t, p.Validate())
+
+	for mode, sameSite := range map[string]http.SameSite{"Lax": http.SameSiteLaxMode, "strict": http.SameSiteStrictMode, "none": http.SameSiteNoneMode} {
+		parsed, err := ParseSameSite(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, sameSite, parsed)
+	}
+	_, err := ParseSameSite("sometimes")
+	assert.Error(t, err)
+}
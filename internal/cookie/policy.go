@@ -0,0 +1,143 @@
+package cookie
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HostPrefix makes browsers only accept the cookie if it is Secure, has no Domain and the Path /, so it can
+	// not be set or shadowed by other subdomains
+	HostPrefix = "__Host-"
+	// SecurePrefix makes browsers only accept the cookie if it is Secure
+	SecurePrefix = "__Secure-"
+)
+
+// DefaultLifetime is how long a session lasts from the login, however active the user is
+const DefaultLifetime = 30 * 24 * time.Hour
+
+// DefaultIdleTimeout is how long a session lasts without any requests
+const DefaultIdleTimeout = 24 * time.Hour
+
+// DefaultLoginStateLifetime is how long a user has to complete the login with the provider, or the second factor
+const DefaultLoginStateLifetime = 10 * time.Minute
+
+// Policy holds the attributes and lifetimes shared by the cookies of the proxy
+type Policy struct {
+	// Domain shares the cookies with all subdomains of the domain, for single sign-on across them. Empty limits
+	// the cookies to the host of the proxy.
+	Domain   string
+	SameSite http.SameSite
+	// Secure makes browsers only send the cookies over HTTPS. It must only be disabled for local development.
+	Secure bool
+	// Prefix is prepended to the cookie names, either HostPrefix, SecurePrefix or empty
+	Prefix string
+
+	// Lifetime is how long a session lasts from the login
+	Lifetime time.Duration
+	// IdleTimeout is how long a session lasts without any requests
+	IdleTimeout time.Duration
+	// LoginStateLifetime is how long a user has to complete the login with the provider, or the second factor
+	LoginStateLifetime time.Duration
+}
+
+// DefaultPolicy returns the policy of secure host-only cookies with SameSite=Lax
+func DefaultPolicy() Policy {
+	return Policy{
+		SameSite:           http.SameSiteLaxMode,
+		Secure:             true,
+		Lifetime:           DefaultLifetime,
+		IdleTimeout:        DefaultIdleTimeout,
+		LoginStateLifetime: DefaultLoginStateLifetime,
+	}
+}
+
+// ParseSameSite parses the SameSite mode lax, strict or none
+func ParseSameSite(mode string) (http.SameSite, error) {
+	switch strings.ToLower(mode) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("unknown SameSite mode %q", mode)
+}
+
+// Validate returns an error if browsers would reject cookies of the policy
+func (p *Policy) Validate() error {
+	switch p.Prefix {
+	case "":
+	case HostPrefix:
+		if p.Domain != "" {
+			return fmt.Errorf("cookies with the %s prefix can not have a domain", HostPrefix)
+		}
+		if !p.Secure {
+			return fmt.Errorf("cookies with the %s prefix must be secure", HostPrefix)
+		}
+	case SecurePrefix:
+		if !p.Secure {
+			return fmt.Errorf("cookies with the %s prefix must be secure", SecurePrefix)
+		}
+	default:
+		return fmt.Errorf("unknown cookie prefix %q", p.Prefix)
+	}
+	if p.SameSite == http.SameSiteNoneMode && !p.Secure {
+		return fmt.Errorf("cookies with SameSite=None must be secure")
+	}
+	if p.Lifetime <= 0 || p.LoginStateLifetime <= 0 {
+		return fmt.Errorf("cookie lifetimes must be positive")
+	}
+	return nil
+}
+
+// Name returns the name of the cookie with the prefix of the policy
+func (p *Policy) Name(name string) string {
+	return p.Prefix + name
+}
+
+// MakeCookie returns the named cookie with the attributes of the policy, kept by the browser for maxAge, which
+// should match how long the value is accepted
+func (p *Policy) MakeCookie(name string, value string, maxAge time.Duration) *http.Cookie {
+	return p.cookie(p.Name(name), value, int(maxAge.Seconds()))
+}
+
+// MakeInvalidationCookie returns a cookie clearing the named cookie
+func (p *Policy) MakeInvalidationCookie(name string) *http.Cookie {
+	return p.cookie(p.Name(name), "", -1)
+}
+
+func (p *Policy) cookie(name string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   p.Domain,
+		HttpOnly: true,
+		Secure:   p.Secure,
+		SameSite: p.SameSite,
+		MaxAge:   maxAge,
+	}
+}
+
+// StaleCookies returns invalidation cookies for the named cookie and its chunks sent with the request, except
+// those being set in keep, so a cookie set with fewer chunks than before leaves no chunks behind
+func (p *Policy) StaleCookies(req *http.Request, name string, keep []*http.Cookie) []*http.Cookie {
+	name = p.Name(name)
+	kept := map[string]bool{}
+	for _, c := range keep {
+		kept[c.Name] = true
+	}
+
+	var stale []*http.Cookie
+	for _, c := range req.Cookies() {
+		if (c.Name == name || isChunkOf(c.Name, name)) && !kept[c.Name] {
+			stale = append(stale, p.cookie(c.Name, "", -1))
+			kept[c.Name] = true
+		}
+	}
+	return stale
+}
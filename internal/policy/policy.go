@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/habakke/auth-proxy/internal/session"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type Action string
+
+const (
+	// AllowAnonymous lets the request through without a session
+	AllowAnonymous Action = "allow-anonymous"
+	// RequireAuth requires a valid session
+	RequireAuth Action = "require-auth"
+	// RequireGroup requires a valid session of a user in one of the groups of the rule
+	RequireGroup Action = "require-group"
+	// RequireEmail requires a valid session of a user with one of the email addresses of the rule, verified by the provider
+	RequireEmail Action = "require-email"
+	// RequireDomain requires a valid session of a user with a verified email address in one of the domains of the rule
+	RequireDomain Action = "require-domain"
+	// Deny rejects the request
+	Deny Action = "deny"
+)
+
+// Rule applies its action to the requests matching all of path, methods and host. Empty matchers match all requests.
+type Rule struct {
+	Name    string   `yaml:"name"`
+	Path    string   `yaml:"path"`
+	Methods []string `yaml:"methods"`
+	Host    string   `yaml:"host"`
+	Action  Action   `yaml:"action"`
+	Groups  []string `yaml:"groups"`
+	Emails  []string `yaml:"emails"`
+	Domains []string `yaml:"domains"`
+
+	path *regexp.Regexp
+	host *regexp.Regexp
+}
+
+// defaultRule applies to requests when no policy is configured
+var defaultRule = &Rule{Name: "default", Action: RequireAuth}
+
+// Policy is an ordered list of rules, where the first rule matching a request decides the action
+type Policy struct {
+	Rules []*Rule `yaml:"rules"`
+	// Default is the action for requests not matching any rule, require-auth if not set
+	Default Action `yaml:"default"`
+
+	defaultRule *Rule
+}
+
+// Load reads the policy from a YAML file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %s", err.Error())
+	}
+
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %s", err.Error())
+	}
+	if err := p.Compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Compile validates the rules and compiles their patterns. It must be called before the policy is used.
+func (p *Policy) Compile() error {
+	if p.Default == "" {
+		p.Default = RequireAuth
+	}
+	p.defaultRule = &Rule{Name: "default", Action: p.Default}
+	if err := p.defaultRule.compile(); err != nil {
+		return err
+	}
+
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i)
+		}
+		if err := r.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("invalid path of %s: %s", r.Name, err.Error())
+		}
+	}
+	if r.Host != "" {
+		if r.host, err = regexp.Compile(r.Host); err != nil {
+			return fmt.Errorf("invalid host of %s: %s", r.Name, err.Error())
+		}
+	}
+
+	switch r.Action {
+	case AllowAnonymous, RequireAuth, Deny:
+	case RequireGroup:
+		if len(r.Groups) == 0 {
+			return fmt.Errorf("%s requires groups", r.Name)
+		}
+	case RequireEmail:
+		if len(r.Emails) == 0 {
+			return fmt.Errorf("%s requires emails", r.Name)
+		}
+	case RequireDomain:
+		if len(r.Domains) == 0 {
+			return fmt.Errorf("%s requires domains", r.Name)
+		}
+	default:
+		return fmt.Errorf("unknown action %q of %s", r.Action, r.Name)
+	}
+	return nil
+}
+
+// Matches returns true if the rule applies to the request
+func (r *Rule) Matches(req *http.Request) bool {
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.host != nil && !r.host.MatchString(hostname(req)) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the action of the rule allows the session, which is nil for anonymous requests
+func (r *Rule) Allows(s *session.Data) bool {
+	switch r.Action {
+	case AllowAnonymous:
+		return true
+	case Deny:
+		return false
+	}
+	if s == nil {
+		return false
+	}
+
+	switch r.Action {
+	case RequireGroup:
+		return s.MemberOf(r.Groups...)
+	case RequireEmail:
+		// unverified addresses can be chosen freely at some providers, so they prove nothing about the user
+		if !s.EmailVerified {
+			return false
+		}
+		for _, email := range r.Emails {
+			if strings.EqualFold(email, s.Email) {
+				return true
+			}
+		}
+		return false
+	case RequireDomain:
+		if !s.EmailVerified {
+			return false
+		}
+		at := strings.LastIndex(s.Email, "@")
+		if at < 0 {
+			return false
+		}
+		for _, domain := range r.Domains {
+			if strings.EqualFold(domain, s.Email[at+1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Groups returns the groups named by the rules
+func (p *Policy) Groups() []string {
+	var groups []string
+	for _, r := range p.Rules {
+		groups = append(groups, r.Groups...)
+	}
+	return groups
+}
+
+// Match returns the first rule matching the request, or the default rule if no rule matches
+func (p *Policy) Match(req *http.Request) *Rule {
+	if p == nil || p.defaultRule == nil {
+		return defaultRule
+	}
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return p.defaultRule
+}
+
+func hostname(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - name: public
+    path: ^/public/
+    methods: [get, HEAD]
+    action: allow-anonymous
+  - name: admin
+    path: ^/admin/
+    action: require-group
+    groups: [admins]
+  - path: ^/owner/
+    action: require-email
+    emails: [owner@example.com]
+  - host: ^internal\.example\.com$
+    action: require-domain
+    domains: [example.com]
+  - path: ^/
+    host: ^app\.example\.com$
+    action: require-auth
+  - name: azure admins
+    path: ^/azure/
+    action: require-group
+    groups: [azure:admins]
+`
+
+func loadTestPolicy(t *testing.T, policy string) (*Policy, error) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0600))
+	return Load(path)
+}
+
+func TestMatch(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		method string
+		url    string
+		rule   string
+	}{
+		{method: "GET", url: "https://app.example.com/public/index.html", rule: "public"},
+		{method: "POST", url: "https://app.example.com/public/index.html", rule: "rule 4"},
+		{method: "POST", url: "https://app.example.com:8443/admin/users", rule: "admin"},
+		{method: "GET", url: "https://app.example.com/owner/", rule: "rule 2"},
+		{method: "GET", url: "https://internal.example.com/", rule: "rule 3"},
+		{method: "GET", url: "https://other.example.com/", rule: "default"},
+	} {
+		require.Equal(t, tt.rule, p.Match(httptest.NewRequest(tt.method, tt.url, nil)).Name, tt.url)
+	}
+
+	// Without a policy all requests require a login
+	var none *Policy
+	require.Equal(t, RequireAuth, none.Match(httptest.NewRequest("GET", "/", nil)).Action)
+}
+
+func TestAllows(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	require.NoError(t, err)
+	rule := func(name string) *Rule {
+		for _, r := range append(p.Rules, p.defaultRule) {
+			if r.Name == name {
+				return r
+			}
+		}
+		return nil
+	}
+
+	user := &session.Data{ID: "test", Email: "owner@Example.com", EmailVerified: true, Groups: []string{"users"}}
+	unverified := &session.Data{ID: "test", Email: "owner@Example.com", Groups: []string{"users"}}
+	admin := &session.Data{ID: "admin", Email: "admin@other.com", EmailVerified: true, Groups: []string{"Admins"}}
+	for _, tt := range []struct {
+		rule    string
+		session *session.Data
+		allowed bool
+	}{
+		{rule: "public", session: nil, allowed: true},
+		{rule: "rule 4", session: nil, allowed: false},
+		{rule: "rule 4", session: user, allowed: true},
+		{rule: "admin", session: user, allowed: false},
+		{rule: "admin", session: admin, allowed: true},
+		{rule: "rule 2", session: user, allowed: true},
+		{rule: "rule 2", session: admin, allowed: false},
+		{rule: "rule 3", session: user, allowed: true},
+		{rule: "rule 3", session: admin, allowed: false},
+		{rule: "rule 2", session: unverified, allowed: false},
+		{rule: "rule 3", session: unverified, allowed: false},
+		{rule: "rule 4", session: unverified, allowed: true},
+		{rule: "default", session: admin, allowed: false},
+		{rule: "azure admins", session: &session.Data{ID: "test", Groups: []string{"admins"}, Provider: "GitHub"}, allowed: false},
+		{rule: "azure admins", session: &session.Data{ID: "test", Groups: []string{"admins"}, Provider: "Azure"}, allowed: true},
+	} {
+		require.Equal(t, tt.allowed, rule(tt.rule).Allows(tt.session), tt.rule)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, policy := range []string{
+		"rules: [{action: maybe}]",
+		"rules: [{action: require-group}]",
+		"rules: [{path: '(', action: deny}]",
+		"default: maybe",
+		"rules: {}",
+	} {
+		_, err := loadTestPolicy(t, policy)
+		require.Error(t, err, policy)
+	}
+}
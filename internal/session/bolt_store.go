@@ -0,0 +1,215 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var (
+	sessionsBucket = []byte("sessions")
+	usersBucket    = []byte("users")
+)
+
+// boltSweepInterval is how often expired sessions are deleted from the file
+const boltSweepInterval = 10 * time.Minute
+
+// BoltStore keeps the sessions in a local BoltDB file, so they survive restarts of the proxy. Each user has a
+// bucket with the IDs of its sessions, so all of them can be revoked at once.
+type BoltStore struct {
+	db *bolt.DB
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session database: %s", err.Error())
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sessionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize session database: %s", err.Error())
+	}
+
+	s := &BoltStore{db: db, done: make(chan struct{})}
+	if err := s.sweep(time.Now()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to delete expired sessions: %s", err.Error())
+	}
+	go s.sweepEvery(boltSweepInterval)
+	return s, nil
+}
+
+// sweepEvery deletes expired sessions at the interval until the store is closed, as sessions which are not read
+// again are otherwise never deleted
+func (s *BoltStore) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if err := s.sweep(now); err != nil {
+				log.Error().AnErr("err", err).Msg("failed to delete expired sessions")
+			}
+		}
+	}
+}
+
+// sweep deletes the expired sessions, and the entries of sessions which no longer exist from the buckets of the
+// users, together with the buckets left empty
+func (s *BoltStore) sweep(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		var expired [][]byte
+		if err := sessions.ForEach(func(id, v []byte) error {
+			stored := storedSession{}
+			if err := json.Unmarshal(v, &stored); err != nil || stored.expired(now) {
+				expired = append(expired, append([]byte(nil), id...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := sessions.Delete(id); err != nil {
+				return err
+			}
+		}
+
+		users := tx.Bucket(usersBucket)
+		var empty [][]byte
+		if err := users.ForEach(func(key, _ []byte) error {
+			user := users.Bucket(key)
+			if user == nil {
+				return nil
+			}
+			var stale [][]byte
+			if err := user.ForEach(func(id, _ []byte) error {
+				if sessions.Get(id) == nil {
+					stale = append(stale, append([]byte(nil), id...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, id := range stale {
+				if err := user.Delete(id); err != nil {
+					return err
+				}
+			}
+			if k, _ := user.Cursor().First(); k == nil {
+				empty = append(empty, append([]byte(nil), key...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, key := range empty {
+			if err := users.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Save(_ context.Context, id string, data Data, expiration time.Duration) error {
+	v, err := json.Marshal(storedSession{Data: data, Expires: time.Now().Add(expiration)})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(sessionsBucket).Put([]byte(id), v); err != nil {
+			return err
+		}
+		user, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(data.UserKey()))
+		if err != nil {
+			return err
+		}
+		return user.Put([]byte(id), nil)
+	})
+}
+
+func (s *BoltStore) Load(_ context.Context, id string) (*Data, error) {
+	stored := &storedSession{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(id))
+		if v == nil {
+			return ErrSessionNotFound
+		}
+		return json.Unmarshal(v, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored.expired(time.Now()) {
+		_ = s.db.Update(func(tx *bolt.Tx) error {
+			return deleteSession(tx, id)
+		})
+		return nil, ErrSessionNotFound
+	}
+	return &stored.Data, nil
+}
+
+func (s *BoltStore) Delete(_ context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteSession(tx, id)
+	})
+}
+
+func (s *BoltStore) DeleteUser(_ context.Context, provider string, userID string) error {
+	key := []byte(UserKey(provider, userID))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user := tx.Bucket(usersBucket).Bucket(key)
+		if user == nil {
+			return nil
+		}
+		sessions := tx.Bucket(sessionsBucket)
+		if err := user.ForEach(func(id, _ []byte) error {
+			return sessions.Delete(id)
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).DeleteBucket(key)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.db.Close()
+}
+
+// deleteSession removes the session and its entry in the bucket of the user
+func deleteSession(tx *bolt.Tx, id string) error {
+	sessions := tx.Bucket(sessionsBucket)
+	v := sessions.Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	stored := storedSession{}
+	if err := json.Unmarshal(v, &stored); err == nil {
+		if user := tx.Bucket(usersBucket).Bucket([]byte(stored.Data.UserKey())); user != nil {
+			if err := user.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+	}
+	return sessions.Delete([]byte(id))
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"crypto/subtle"
+	"github.com/habakke/auth-proxy/internal/cookie"
+	"net/http"
+)
+
+// LoginCSRFCookieName is the cookie holding the CSRF token of the local login form
+const LoginCSRFCookieName = "login_csrf"
+
+// AttachCSRFToken returns a new CSRF token to render into the login form, and sets the cookie the submitted token
+// is checked against. The cookie is sealed, so it can not be forged, but a sibling subdomain can still plant a
+// cookie and token pair fetched from the proxy. Only the __Host- cookie prefix prevents that.
+func (m *Manager) AttachCSRFToken(res http.ResponseWriter) (string, error) {
+	token, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+
+	c, err := m.makeEncryptedCookie(LoginCSRFCookieName, m.keyring, token, m.policy.LoginStateLifetime)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(res, c)
+	return token, nil
+}
+
+// VerifyCSRFToken returns true if the token submitted with the form matches the CSRF cookie of the request
+func (m *Manager) VerifyCSRFToken(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	c, err := req.Cookie(m.policy.Name(LoginCSRFCookieName))
+	if err != nil {
+		return false
+	}
+	expected, _, _, err := readEncryptedCookie(c, m.cookieSeed, m.keyring, nil, m.policy.LoginStateLifetime)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+func (m *Manager) RemoveCSRFToken(res http.ResponseWriter) {
+	http.SetCookie(res, m.policy.MakeInvalidationCookie(LoginCSRFCookieName))
+}
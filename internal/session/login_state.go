@@ -0,0 +1,35 @@
+package session
+
+import (
+	"github.com/habakke/auth-proxy/internal/cookie"
+	"golang.org/x/oauth2"
+)
+
+// LoginState is kept in a short-lived cookie between the authorization request and the callback
+type LoginState struct {
+	// State is the CSRF token sent as the OAuth2 state parameter
+	State string `json:"state"`
+	// Nonce binds the ID token to the authorization request
+	Nonce string `json:"nonce"`
+	// CodeVerifier is the PKCE (RFC 7636) secret matching the code challenge of the authorization request
+	CodeVerifier string `json:"code_verifier"`
+	// Redirect is the URL the user originally requested, and is sent back to after login
+	Redirect string `json:"redirect,omitempty"`
+}
+
+func NewLoginState() (*LoginState, error) {
+	state, err := cookie.Nonce()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the sessions in memory. Sessions are lost when the proxy restarts, and are not shared
+// between replicas.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*storedSession
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]*storedSession{}}
+}
+
+func (s *MemoryStore) Save(_ context.Context, id string, data Data, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	s.sessions[id] = &storedSession{Data: data, Expires: now.Add(expiration)}
+	return nil
+}
+
+func (s *MemoryStore) Load(_ context.Context, id string) (*Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.sessions[id]
+	if !ok || stored.expired(time.Now()) {
+		return nil, ErrSessionNotFound
+	}
+	data := stored.Data
+	return &data, nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(_ context.Context, provider string, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := UserKey(provider, userID)
+	for id, stored := range s.sessions {
+		if stored.Data.UserKey() == key {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// expire removes the expired sessions, so abandoned sessions do not grow the map forever
+func (s *MemoryStore) expire(now time.Time) {
+	for id, stored := range s.sessions {
+		if stored.expired(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
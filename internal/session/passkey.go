@@ -0,0 +1,45 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// PasskeyCookieName is the cookie holding the state of a passkey registration or login between its two requests
+const PasskeyCookieName = "passkey_state"
+
+// AttachPasskeyState stores the state of the WebAuthn ceremony, including its challenge, in a sealed and short-lived
+// cookie
+func (m *Manager) AttachPasskeyState(res http.ResponseWriter, state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	c, err := m.makeEncryptedCookie(PasskeyCookieName, m.keyring, string(data), m.policy.LoginStateLifetime)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(res, c)
+	return nil
+}
+
+func (m *Manager) ReadPasskeyState(req *http.Request, state interface{}) error {
+	name := m.policy.Name(PasskeyCookieName)
+	c, err := req.Cookie(name)
+	if err != nil {
+		return fmt.Errorf("cookie %q not present", name)
+	}
+
+	data, _, _, err := readEncryptedCookie(c, m.cookieSeed, m.keyring, nil, m.policy.LoginStateLifetime)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), state)
+}
+
+func (m *Manager) RemovePasskeyState(res http.ResponseWriter) {
+	http.SetCookie(res, m.policy.MakeInvalidationCookie(PasskeyCookieName))
+}
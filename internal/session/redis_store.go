@@ -0,0 +1,105 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// RedisStore keeps the sessions in Redis, so they are shared between replicas of the proxy. Sessions are
+// stored as JSON with a TTL, and each user has a set with the IDs of its sessions.
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisStore returns a store using the Redis server at the URL, for example redis://:password@host:6379/0
+func NewRedisStore(url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisStoreWithClient(redis.NewClient(opts)), nil
+}
+
+func NewRedisStoreWithClient(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client, prefix: "auth-proxy:"}
+}
+
+func (s *RedisStore) sessionKey(id string) string {
+	return s.prefix + "session:" + id
+}
+
+func (s *RedisStore) userKey(userKey string) string {
+	return s.prefix + "user:" + userKey
+}
+
+func (s *RedisStore) Save(ctx context.Context, id string, data Data, expiration time.Duration) error {
+	v, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	userKey := s.userKey(data.UserKey())
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.sessionKey(id), v, expiration)
+		pipe.SAdd(ctx, userKey, id)
+		// the set lives as long as the longest lived session of the user, so the TTL is set if the set is new and
+		// can only be extended. Saving an older session must not let the set expire before the newer ones.
+		pipe.ExpireNX(ctx, userKey, expiration)
+		pipe.ExpireGT(ctx, userKey, expiration)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Load(ctx context.Context, id string) (*Data, error) {
+	v, err := s.client.Get(ctx, s.sessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	d := &Data{}
+	if err := json.Unmarshal(v, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	d, err := s.Load(ctx, id)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.sessionKey(id))
+		pipe.SRem(ctx, s.userKey(d.UserKey()), id)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) DeleteUser(ctx context.Context, provider string, userID string) error {
+	userKey := s.userKey(UserKey(provider, userID))
+	ids, err := s.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userKey}
+	for _, id := range ids {
+		keys = append(keys, s.sessionKey(id))
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -1,8 +1,65 @@
 package session
 
+import (
+	"strings"
+	"time"
+)
+
 type Data struct {
-	ID         string `json:"id,omitempty"`
-	Email      string `json:"email,omitempty"`
-	Name       string `json:"name,omitempty"`
-	Authorized bool   `json:"authorized"`
+	ID            string   `json:"id,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	// HostedDomain is the organization domain managing the account, for providers reporting it
+	HostedDomain string `json:"hd,omitempty"`
+	Provider     string `json:"provider,omitempty"`
+	Authorized   bool   `json:"authorized"`
+	// SecondFactorPending is set once the password of a user who has to use a second factor is checked, until the
+	// second factor is verified. Such sessions are not authenticated.
+	SecondFactorPending bool `json:"mfa_pending,omitempty"`
+	// CreatedAt is the unix time of the login, from which the absolute lifetime of the session is counted
+	CreatedAt int64 `json:"created_at,omitempty"`
+	// SessionID is the ID of the session in the session store, and is never part of the session cookie
+	SessionID string `json:"-"`
+
+	// issuedAt is when the session cookie was last issued, from which the idle timeout is counted
+	issuedAt time.Time
+	// stale is true if the session cookie is in the legacy format or sealed with an old key, and should be re-issued
+	stale bool
+}
+
+// InGroup returns true if the session belongs to any of the groups, compared case-insensitively
+func (d *Data) InGroup(groups ...string) bool {
+	for _, g := range d.Groups {
+		for _, group := range groups {
+			if strings.EqualFold(g, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MemberOf returns true if the session belongs to any of the groups, which may be qualified with the provider
+// issuing them, ex. github:my-org/admins. Qualified groups only match sessions of that provider, as group names are
+// only unique within a provider.
+func (d *Data) MemberOf(groups ...string) bool {
+	for _, group := range groups {
+		if provider, name, ok := strings.Cut(group, ":"); ok {
+			if !strings.EqualFold(provider, d.Provider) {
+				continue
+			}
+			group = name
+		}
+		if d.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// QualifiedGroup returns true if the group names the provider issuing it, ex. github:my-org/admins
+func QualifiedGroup(group string) bool {
+	return strings.Contains(group, ":")
 }
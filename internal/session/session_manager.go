@@ -1,93 +1,350 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/habakke/auth-proxy/internal/cookie"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-const MaxSessionDuration = 30
 const SessionCookieName = "session"
 
 type Manager struct {
 	cookieSeed string
-	cookieKey  string
+	cookieKeys []string
+	keyring    *cookie.Keyring
+	store      Store
+	policy     cookie.Policy
 }
 
 func NewManager(cookieSeed string, cookieKey string) *Manager {
-	return &Manager{
+	m := &Manager{
 		cookieSeed: cookieSeed,
-		cookieKey:  cookieKey,
+		policy:     cookie.DefaultPolicy(),
 	}
+	if err := m.SetKeys(cookieKey); err != nil {
+		log.Error().AnErr("err", err).Msg("invalid cookie key")
+	}
+	return m
+}
+
+// SetKeys sets the keyring of the cookies. New cookies are sealed with the first key, while cookies sealed with
+// any of the keys are accepted and re-issued with the first key. To rotate keys without signing users out, add the
+// new key last, then move it first once all replicas have it, and remove the old key when its cookies have expired.
+func (m *Manager) SetKeys(keys ...string) error {
+	keyring, err := cookie.NewKeyring(keys...)
+	if err != nil {
+		return err
+	}
+	m.cookieKeys = keys
+	m.keyring = keyring
+	return nil
+}
+
+// SetPolicy sets the attributes and lifetimes of the session and login state cookies. An idle timeout of zero, or
+// longer than the lifetime, disables the idle timeout.
+func (m *Manager) SetPolicy(policy cookie.Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if policy.IdleTimeout <= 0 || policy.IdleTimeout > policy.Lifetime {
+		policy.IdleTimeout = policy.Lifetime
+	}
+	m.policy = policy
+	return nil
+}
+
+// Policy returns the cookie policy of the manager
+func (m *Manager) Policy() cookie.Policy {
+	return m.policy
+}
+
+// expiresIn returns how long the session is valid if issued now, which is the idle timeout unless the end of
+// the lifetime of the session is closer. Sessions waiting for the second factor only last as long as the login
+// state, as they are only needed to finish the login.
+func (m *Manager) expiresIn(session *Data, now time.Time) time.Duration {
+	lifetime, idleTimeout := m.policy.Lifetime, m.policy.IdleTimeout
+	if session.SecondFactorPending {
+		lifetime, idleTimeout = m.policy.LoginStateLifetime, m.policy.LoginStateLifetime
+	}
+	remaining := time.Unix(session.CreatedAt, 0).Add(lifetime).Sub(now)
+	if remaining < idleTimeout {
+		return remaining
+	}
+	return idleTimeout
+}
+
+// SetStore keeps the sessions in the store, so the session cookie only holds an opaque session ID. Without a
+// store the whole session is kept in the cookie, and sessions can not be revoked.
+func (m *Manager) SetStore(store Store) {
+	m.store = store
 }
 
 func (m *Manager) MakeSessionCookie(seed string, key string, payload string) (*http.Cookie, error) {
-	encryptedPayload, err := cookie.EncryptCookieValue(key, payload)
+	keyring, err := cookie.NewKeyring(key)
 	if err != nil {
 		return nil, err
 	}
-	v := cookie.SignCookieValue(seed, SessionCookieName, encryptedPayload, time.Now())
-	return cookie.MakeCookie(SessionCookieName, v), nil
+	return m.makeEncryptedCookie(SessionCookieName, keyring, payload, m.policy.IdleTimeout)
 }
 
 func (m *Manager) ReadSessionCookie(c *http.Cookie, cookieSeed string, cookieKey string) (string, error) {
-	if c.Name != SessionCookieName {
+	if c.Name != m.policy.Name(SessionCookieName) {
 		return "", fmt.Errorf("cookie is not a session cookie")
 	}
 
-	encryptedValue, _, ok := cookie.Validate(c, cookieSeed, time.Hour*24*MaxSessionDuration)
-	if !ok {
-		return "", fmt.Errorf("failed to validate cookie")
+	keyring, err := cookie.NewKeyring(cookieKey)
+	if err != nil {
+		return "", err
+	}
+	data, _, _, err := readEncryptedCookie(c, cookieSeed, keyring, []string{cookieKey}, m.policy.IdleTimeout)
+	return data, err
+}
+
+// makeEncryptedCookie returns a cookie of the policy with the payload sealed with the primary key of the keyring,
+// kept by the browser for expiration
+func (m *Manager) makeEncryptedCookie(name string, keyring *cookie.Keyring, payload string, expiration time.Duration) (*http.Cookie, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("no valid cookie key")
 	}
-	data, err := cookie.DecryptCookieValue(cookieKey, encryptedValue)
+	v, err := keyring.Seal(m.policy.Name(name), payload, time.Now())
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt cookie payload")
+		return nil, err
+	}
+	return m.policy.MakeCookie(name, v, expiration), nil
+}
+
+// readEncryptedCookie authenticates and checks the age of the cookie, and returns the decrypted payload and the
+// time the cookie was issued. Cookies in the legacy format, signed with the seed and encrypted with AES-CFB using
+// one of the legacy keys, are still accepted. Stale is true for cookies which should be re-issued, because they
+// are in the legacy format or not sealed with the primary key.
+func readEncryptedCookie(c *http.Cookie, cookieSeed string, keyring *cookie.Keyring, legacyKeys []string, expiration time.Duration) (data string, t time.Time, stale bool, err error) {
+	if cookie.IsVersioned(c.Value) {
+		if keyring == nil {
+			return "", t, false, fmt.Errorf("no valid cookie key")
+		}
+		data, t, primary, err := keyring.Open(c, expiration)
+		if err != nil {
+			return "", t, false, fmt.Errorf("failed to validate cookie: %s", err.Error())
+		}
+		return data, t, !primary, nil
+	}
+
+	encryptedValue, t, ok := cookie.Validate(c, cookieSeed, expiration)
+	if !ok {
+		return "", t, true, fmt.Errorf("failed to validate cookie")
+	}
+	for _, key := range legacyKeys {
+		// AES-CFB has no integrity check, but the value was signed, so the first key that decrypts it to text is
+		// taken as the key it was encrypted with
+		if data, err = cookie.DecryptCookieValue(key, encryptedValue); err == nil && isText(data) {
+			return data, t, true, nil
+		}
 	}
 
-	return data, nil
+	return "", t, true, fmt.Errorf("failed to decrypt cookie payload")
 }
 
 func (m *Manager) ReadSession(req *http.Request) (*Data, error) {
-	c, err := req.Cookie(SessionCookieName)
+	c, err := cookie.JoinCookies(req, m.policy.Name(SessionCookieName))
 	if err != nil {
-		return nil, fmt.Errorf("cookie %q not present", SessionCookieName)
+		return nil, err
 	}
 
-	var data string
-	data, err = m.ReadSessionCookie(c, m.cookieSeed, m.cookieKey)
+	data, issuedAt, stale, err := readEncryptedCookie(c, m.cookieSeed, m.keyring, m.cookieKeys, m.policy.IdleTimeout)
 	if err != nil {
 		log.Error().AnErr("err", err).Str("data", c.Value).Msg("failed to read session cookie")
 		return nil, err
 	}
 
-	d := Data{}
-	if err = json.Unmarshal([]byte(data), &d); err != nil {
+	d := &Data{}
+	if m.store != nil {
+		if d, err = m.store.Load(req.Context(), data); err != nil {
+			if !errors.Is(err, ErrSessionNotFound) {
+				log.Error().AnErr("err", err).Msg("failed to load session")
+			}
+			return nil, err
+		}
+		d.SessionID = data
+	} else if err = json.Unmarshal([]byte(data), d); err != nil {
 		log.Error().AnErr("err", err).Str("data", c.Value).Msg("failed to unmarshal auth cookie data")
 		return nil, err
 	}
 
-	return &d, err
+	// sessions from before the lifetime was tracked were never re-issued, so the cookie is as old as the login
+	if d.CreatedAt == 0 {
+		d.CreatedAt = issuedAt.Unix()
+	}
+	if m.expiresIn(d, time.Now()) <= 0 {
+		return nil, fmt.Errorf("session has expired")
+	}
+	d.issuedAt = issuedAt
+	d.stale = stale
+
+	return d, nil
 }
 
-func (m *Manager) AttachSession(res http.ResponseWriter, session Data) error {
-	data, err := json.Marshal(session)
+// AttachSession sets the session cookie, split into chunks if it is too large for browsers. With a store the session is saved under its session ID, or a new
+// random ID for new sessions, and the cookie only holds the ID.
+func (m *Manager) AttachSession(res http.ResponseWriter, req *http.Request, session Data) error {
+	now := time.Now()
+	if session.CreatedAt == 0 {
+		session.CreatedAt = now.Unix()
+	}
+	expiration := m.expiresIn(&session, now)
+	if expiration <= 0 {
+		return fmt.Errorf("session has expired")
+	}
+
+	var payload string
+	if m.store != nil {
+		if session.SessionID == "" {
+			id, err := newSessionID()
+			if err != nil {
+				return err
+			}
+			session.SessionID = id
+		}
+		if err := m.store.Save(req.Context(), session.SessionID, session, expiration); err != nil {
+			return err
+		}
+		payload = session.SessionID
+	} else {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		payload = string(data)
+	}
+
+	c, err := m.makeEncryptedCookie(SessionCookieName, m.keyring, payload, expiration)
 	if err != nil {
 		return err
 	}
 
-	c, err := m.MakeSessionCookie(m.cookieSeed, m.cookieKey, string(data))
+	cookies := cookie.SplitCookie(c)
+	for _, stale := range m.policy.StaleCookies(req, SessionCookieName, cookies) {
+		http.SetCookie(res, stale)
+	}
+	for _, c := range cookies {
+		http.SetCookie(res, c)
+	}
+	return nil
+}
+
+// RefreshSession re-issues the session cookie when more than half of the idle timeout has passed since it was
+// issued, so active users are not signed out. Cookies in the legacy format or sealed with an old key are re-issued
+// right away. The absolute lifetime of the session is not extended.
+func (m *Manager) RefreshSession(res http.ResponseWriter, req *http.Request, session *Data) error {
+	if session == nil || session.issuedAt.IsZero() {
+		return nil
+	}
+	if !session.stale && time.Since(session.issuedAt) < m.policy.IdleTimeout/2 {
+		return nil
+	}
+	return m.AttachSession(res, req, *session)
+}
+
+// RenewSession issues the session under a new session ID and deletes the old one from the store, so an ID which
+// was exposed before the session gained privileges, such as by verifying the second factor, can not be used after
+func (m *Manager) RenewSession(res http.ResponseWriter, req *http.Request, session Data) error {
+	if m.store != nil && session.SessionID != "" {
+		if err := m.store.Delete(req.Context(), session.SessionID); err != nil {
+			return err
+		}
+	}
+	session.SessionID = ""
+	return m.AttachSession(res, req, session)
+}
+
+// RemoveSession clears the session cookie and its chunks, and deletes the session from the store
+func (m *Manager) RemoveSession(res http.ResponseWriter, req *http.Request) {
+	if m.store != nil {
+		if s, err := m.ReadSession(req); err == nil {
+			if err := m.store.Delete(req.Context(), s.SessionID); err != nil {
+				log.Error().AnErr("err", err).Msg("failed to delete session")
+			}
+		}
+	}
+
+	c := m.policy.MakeInvalidationCookie(SessionCookieName)
+	http.SetCookie(res, c)
+	for _, stale := range m.policy.StaleCookies(req, SessionCookieName, []*http.Cookie{c}) {
+		http.SetCookie(res, stale)
+	}
+}
+
+// RevokeUser deletes all sessions of a user at a provider, signing it out everywhere. It requires a store.
+func (m *Manager) RevokeUser(ctx context.Context, provider string, userID string) error {
+	if m.store == nil {
+		return fmt.Errorf("sessions can not be revoked without a session store")
+	}
+	return m.store.DeleteUser(ctx, provider, userID)
+}
+
+// HasStore returns true if the sessions are kept in a store and can be revoked
+func (m *Manager) HasStore() bool {
+	return m.store != nil
+}
+
+// AttachLoginState stores the login state in a signed, encrypted and short-lived cookie
+func (m *Manager) AttachLoginState(res http.ResponseWriter, state LoginState) error {
+	data, err := json.Marshal(state)
 	if err != nil {
 		return err
 	}
 
+	c, err := m.makeEncryptedCookie(cookie.CSRFCookieName, m.keyring, string(data), m.policy.LoginStateLifetime)
+	if err != nil {
+		return err
+	}
+	// the provider redirects back to the callback from another site, which browsers only send Lax cookies with
+	if c.SameSite == http.SameSiteStrictMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+
 	http.SetCookie(res, c)
 	return nil
 }
 
-func (m *Manager) RemoveSession(res http.ResponseWriter) {
-	c := cookie.MakeInvalidationCookie(SessionCookieName)
-	http.SetCookie(res, c)
+func (m *Manager) ReadLoginState(req *http.Request) (*LoginState, error) {
+	name := m.policy.Name(cookie.CSRFCookieName)
+	c, err := req.Cookie(name)
+	if err != nil {
+		return nil, fmt.Errorf("cookie %q not present", name)
+	}
+
+	data, _, _, err := readEncryptedCookie(c, m.cookieSeed, m.keyring, m.cookieKeys, m.policy.LoginStateLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	s := LoginState{}
+	if err = json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *Manager) RemoveLoginState(res http.ResponseWriter) {
+	http.SetCookie(res, m.policy.MakeInvalidationCookie(cookie.CSRFCookieName))
+}
+
+// isText returns true if the value is valid UTF-8 without control characters, which random bytes almost never are
+func isText(value string) bool {
+	if !utf8.ValidString(value) {
+		return false
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
 }
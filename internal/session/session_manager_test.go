@@ -1,6 +1,7 @@
 package session
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/habakke/auth-proxy/internal/cookie"
 	"github.com/stretchr/testify/assert"
@@ -17,7 +18,7 @@ func bootstrapTestServer(sm *Manager) (srv *httptest.Server) {
 	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		switch req.URL.Path {
 		case "/attach":
-			_ = sm.AttachSession(res, Data{ID: "test", Name: "test", Authorized: false})
+			_ = sm.AttachSession(res, req, Data{ID: "test", Name: "test", Authorized: false})
 		default:
 			hostname, _, _ := net.SplitHostPort(req.Host)
 			_, _ = res.Write([]byte(fmt.Sprintf("hostname=%s\n", hostname)))
@@ -58,20 +59,50 @@ func TestAuthenticatedSession(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to create session cookie")
 	}
+	assert.True(t, cookie.IsVersioned(c.Value))
 
-	encryptedData, _, ok := cookie.Validate(c, cookieSeed, time.Hour*24)
-	if !ok {
-		t.Errorf("failed to validate session cookie")
-	}
-
-	data, err := cookie.DecryptCookieValue(cookieKey, encryptedData)
+	aead, err := cookie.NewAEAD(cookieKey)
+	assert.NoError(t, err)
+	data, _, err := aead.Open(c, time.Hour*24)
 	if err != nil {
-		t.Errorf("failed to decrypt cookie data")
+		t.Errorf("failed to open session cookie")
 	}
 
 	assert.Equal(t, cookiePayload, data, "payload is not as expected")
 }
 
+func TestLegacySessionCookie(t *testing.T) {
+	cookieSeed := "0123456789abcdefghijklmnopqrstuv"
+	cookieKey := "2345asdYDS!2012L"
+	sm := NewManager(cookieSeed, cookieKey)
+
+	// Cookies signed with the seed and encrypted with AES-CFB are still accepted
+	payload, _ := json.Marshal(Data{ID: "test", Name: "test"})
+	encrypted, err := cookie.EncryptCookieValue(cookieKey, string(payload))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: cookie.SignCookieValue(cookieSeed, SessionCookieName, encrypted, time.Now())})
+	d, err := sm.ReadSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", d.Name)
+
+	// and upgraded on the next request
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.RefreshSession(res, req, d))
+	cookies := res.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, cookie.IsVersioned(cookies[0].Value))
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	d, err = sm.ReadSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", d.Name)
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.RefreshSession(res, req, d))
+	assert.Empty(t, res.Result().Cookies())
+}
+
 func TestAttachSession(t *testing.T) {
 	cookieSeed := "0123456789abcdefghijklmnopqrstuv"
 	cookieKey := "2345asdYDS!2012L"
@@ -95,3 +126,244 @@ func TestAttachSession(t *testing.T) {
 
 	assert.Equal(t, "test", data.Name)
 }
+
+func TestLoginState(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	state, err := NewLoginState()
+	assert.NoError(t, err)
+	assert.NotEqual(t, state.State, state.Nonce)
+	assert.NotEmpty(t, state.CodeVerifier)
+
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.AttachLoginState(res, *state))
+
+	req := httptest.NewRequest("GET", "/auth/google/callback", nil)
+	for _, c := range res.Result().Cookies() {
+		assert.Equal(t, int(cookie.DefaultLoginStateLifetime.Seconds()), c.MaxAge)
+		req.AddCookie(c)
+	}
+	read, err := sm.ReadLoginState(req)
+	assert.NoError(t, err)
+	assert.Equal(t, state, read)
+
+	_, err = sm.ReadLoginState(httptest.NewRequest("GET", "/auth/google/callback", nil))
+	assert.Error(t, err)
+}
+
+func TestSessionLifetime(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	policy := cookie.DefaultPolicy()
+	policy.Lifetime, policy.IdleTimeout = 2*time.Hour, time.Hour
+	assert.NoError(t, sm.SetPolicy(policy))
+
+	// sessionRequest returns a request with a session cookie issued at the time
+	sessionRequest := func(d Data, issuedAt time.Time) *http.Request {
+		payload, _ := json.Marshal(d)
+		value, err := sm.keyring.Seal(SessionCookieName, string(payload), issuedAt)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: value})
+		return req
+	}
+	now := time.Now()
+
+	// The cookie is kept by the browser for as long as it is accepted
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test"}))
+	assert.Equal(t, 3600, res.Result().Cookies()[0].MaxAge)
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test", CreatedAt: now.Add(-110 * time.Minute).Unix()}))
+	assert.InDelta(t, 600, res.Result().Cookies()[0].MaxAge, 2)
+
+	// Sessions are re-issued when they are close to the idle timeout
+	req := sessionRequest(Data{ID: "test", CreatedAt: now.Add(-45 * time.Minute).Unix()}, now.Add(-45*time.Minute))
+	d, err := sm.ReadSession(req)
+	assert.NoError(t, err)
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.RefreshSession(res, req, d))
+	assert.Len(t, res.Result().Cookies(), 1)
+
+	req = sessionRequest(Data{ID: "test", CreatedAt: now.Add(-45 * time.Minute).Unix()}, now.Add(-10*time.Minute))
+	d, err = sm.ReadSession(req)
+	assert.NoError(t, err)
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.RefreshSession(res, req, d))
+	assert.Empty(t, res.Result().Cookies())
+
+	// Idle sessions expire
+	_, err = sm.ReadSession(sessionRequest(Data{ID: "test", CreatedAt: now.Add(-61 * time.Minute).Unix()}, now.Add(-61*time.Minute)))
+	assert.Error(t, err)
+
+	// Active sessions expire at the end of their lifetime
+	_, err = sm.ReadSession(sessionRequest(Data{ID: "test", CreatedAt: now.Add(-121 * time.Minute).Unix()}, now.Add(-10*time.Minute)))
+	assert.Error(t, err)
+
+	// Sessions waiting for the second factor only last as long as the login state
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test", SecondFactorPending: true}))
+	assert.InDelta(t, cookie.DefaultLoginStateLifetime.Seconds(), res.Result().Cookies()[0].MaxAge, 2)
+	_, err = sm.ReadSession(sessionRequest(Data{ID: "test", SecondFactorPending: true, CreatedAt: now.Add(-11 * time.Minute).Unix()}, now.Add(-11*time.Minute)))
+	assert.Error(t, err)
+
+	// Sessions from before the lifetime was tracked are as old as their cookie
+	d, err = sm.ReadSession(sessionRequest(Data{ID: "test"}, now.Add(-10*time.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-10*time.Minute).Unix(), d.CreatedAt)
+}
+
+func TestKeyRotation(t *testing.T) {
+	cookieSeed := "0123456789abcdefghijklmnopqrstuv"
+	oldKey, newKey := "2345asdYDS!2012L", "abcdefghijklmnopqrstuvwxyz012345"
+	sm := NewManager(cookieSeed, oldKey)
+	assert.Error(t, sm.SetKeys())
+	assert.Error(t, sm.SetKeys(newKey, "short"))
+
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test", Name: "test"}))
+	oldCookie := res.Result().Cookies()[0]
+	payload, _ := json.Marshal(Data{ID: "legacy", Name: "legacy"})
+	encrypted, err := cookie.EncryptCookieValue(oldKey, string(payload))
+	assert.NoError(t, err)
+	legacyCookie := &http.Cookie{Name: SessionCookieName, Value: cookie.SignCookieValue(cookieSeed, SessionCookieName, encrypted, time.Now())}
+
+	read := func(c *http.Cookie) (*Data, *httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		d, err := sm.ReadSession(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		res := httptest.NewRecorder()
+		assert.NoError(t, sm.RefreshSession(res, req, d))
+		return d, res, nil
+	}
+
+	// Cookies of the old key are accepted after the new key is promoted, and re-issued with the new key
+	assert.NoError(t, sm.SetKeys(newKey, oldKey))
+	for _, c := range []*http.Cookie{oldCookie, legacyCookie} {
+		d, res, err := read(c)
+		assert.NoError(t, err)
+		cookies := res.Result().Cookies()
+		assert.Len(t, cookies, 1)
+
+		// and the re-issued cookie is still accepted after the old key is retired
+		assert.NoError(t, sm.SetKeys(newKey))
+		reissued, res, err := read(cookies[0])
+		assert.NoError(t, err)
+		assert.Equal(t, d.Name, reissued.Name)
+		assert.Empty(t, res.Result().Cookies())
+		_, _, err = read(c)
+		assert.Error(t, err)
+		assert.NoError(t, sm.SetKeys(newKey, oldKey))
+	}
+}
+
+func TestChunkedSession(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+
+	var groups []string
+	for i := 0; i < 500; i++ {
+		groups = append(groups, fmt.Sprintf("group-%d", i))
+	}
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test", Groups: groups}))
+	chunks := res.Result().Cookies()
+	assert.Greater(t, len(chunks), 1)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range chunks {
+		assert.LessOrEqual(t, len(c.Name)+len(c.Value), cookie.MaxCookieSize)
+		req.AddCookie(c)
+	}
+	d, err := sm.ReadSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, groups, d.Groups)
+
+	// A smaller session clears the chunks
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, req, Data{ID: "test"}))
+	cookies := res.Result().Cookies()
+	assert.Len(t, cookies, len(chunks)+1)
+	for _, c := range cookies[:len(chunks)] {
+		assert.Equal(t, -1, c.MaxAge)
+	}
+	assert.Equal(t, SessionCookieName, cookies[len(chunks)].Name)
+
+	// Removing the session clears the chunks
+	res = httptest.NewRecorder()
+	sm.RemoveSession(res, req)
+	cookies = res.Result().Cookies()
+	assert.Len(t, cookies, len(chunks)+1)
+	for _, c := range cookies {
+		assert.Equal(t, -1, c.MaxAge)
+	}
+}
+
+func TestCookiePolicy(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	policy := cookie.DefaultPolicy()
+	policy.Prefix = cookie.HostPrefix
+	policy.Secure = false
+	assert.Error(t, sm.SetPolicy(policy))
+
+	policy = cookie.DefaultPolicy()
+	policy.Prefix = cookie.SecurePrefix
+	policy.Domain = "example.com"
+	policy.SameSite = http.SameSiteStrictMode
+	assert.NoError(t, sm.SetPolicy(policy))
+
+	res := httptest.NewRecorder()
+	assert.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "test"}))
+	c := res.Result().Cookies()[0]
+	assert.Equal(t, "__Secure-session", c.Name)
+	assert.Equal(t, "example.com", c.Domain)
+	assert.Equal(t, http.SameSiteStrictMode, c.SameSite)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	d, err := sm.ReadSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", d.ID)
+
+	// Cookies are cleared with the attributes they were set with
+	res = httptest.NewRecorder()
+	sm.RemoveSession(res, req)
+	c = res.Result().Cookies()[0]
+	assert.Equal(t, "__Secure-session", c.Name)
+	assert.Equal(t, "example.com", c.Domain)
+	assert.Equal(t, -1, c.MaxAge)
+
+	// The login state survives the cross-site redirect back from the provider
+	res = httptest.NewRecorder()
+	assert.NoError(t, sm.AttachLoginState(res, LoginState{State: "state"}))
+	c = res.Result().Cookies()[0]
+	assert.Equal(t, "__Secure-csrf_state", c.Name)
+	assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	state, err := sm.ReadLoginState(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "state", state.State)
+}
+
+func TestCSRFToken(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	res := httptest.NewRecorder()
+	token, err := sm.AttachCSRFToken(res)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	c := res.Result().Cookies()[0]
+	assert.Equal(t, LoginCSRFCookieName, c.Name)
+	assert.NotContains(t, c.Value, token)
+
+	req := httptest.NewRequest("POST", "/auth/login", nil)
+	req.AddCookie(c)
+	assert.True(t, sm.VerifyCSRFToken(req, token))
+	assert.False(t, sm.VerifyCSRFToken(req, ""))
+	assert.False(t, sm.VerifyCSRFToken(req, token+"0"))
+	assert.False(t, sm.VerifyCSRFToken(httptest.NewRequest("POST", "/auth/login", nil), token))
+
+	// A cookie set by someone else, without the key, is rejected
+	req = httptest.NewRequest("POST", "/auth/login", nil)
+	req.AddCookie(&http.Cookie{Name: LoginCSRFCookieName, Value: token})
+	assert.False(t, sm.VerifyCSRFToken(req, token))
+}
@@ -0,0 +1,54 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Store keeps sessions on the server, so the session cookie only has to hold an opaque session ID
+type Store interface {
+	// Save stores the session with the ID until the expiration has passed
+	Save(ctx context.Context, id string, data Data, expiration time.Duration) error
+	// Load returns the session with the ID, or ErrSessionNotFound if it does not exist or has expired
+	Load(ctx context.Context, id string) (*Data, error)
+	// Delete removes the session with the ID
+	Delete(ctx context.Context, id string) error
+	// DeleteUser removes all sessions of a user at a provider
+	DeleteUser(ctx context.Context, provider string, userID string) error
+	Close() error
+}
+
+// UserKey returns the key identifying the user of the session across all of its sessions
+func (d *Data) UserKey() string {
+	return UserKey(d.Provider, d.ID)
+}
+
+// UserKey returns the key identifying a user at a provider
+func UserKey(provider string, userID string) string {
+	return strings.ToLower(provider) + ":" + userID
+}
+
+// newSessionID returns a random and unguessable session ID
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// storedSession is a session with its expiry, as kept by the memory and file stores
+type storedSession struct {
+	Data    Data      `json:"data"`
+	Expires time.Time `json:"expires"`
+}
+
+func (s *storedSession) expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
@@ -0,0 +1,186 @@
+package session
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStores(t *testing.T) (map[string]Store, *miniredis.Miniredis) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	mr := miniredis.RunT(t)
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   bolt,
+		"redis":  NewRedisStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+	}
+	t.Cleanup(func() {
+		for _, s := range stores {
+			_ = s.Close()
+		}
+	})
+	return stores, mr
+}
+
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+	stores, _ := testStores(t)
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.Load(ctx, "missing")
+			require.ErrorIs(t, err, ErrSessionNotFound)
+
+			one := Data{ID: "1", Provider: "Google", Email: "one@example.com", Groups: []string{"admins"}}
+			two := Data{ID: "2", Provider: "GitHub", Email: "two@example.com"}
+			require.NoError(t, s.Save(ctx, "a", one, time.Hour))
+			require.NoError(t, s.Save(ctx, "b", one, time.Hour))
+			require.NoError(t, s.Save(ctx, "c", two, time.Hour))
+
+			d, err := s.Load(ctx, "a")
+			require.NoError(t, err)
+			require.Equal(t, one, *d)
+
+			// Deleting a session leaves the other sessions of the user
+			require.NoError(t, s.Delete(ctx, "a"))
+			require.NoError(t, s.Delete(ctx, "a"))
+			_, err = s.Load(ctx, "a")
+			require.ErrorIs(t, err, ErrSessionNotFound)
+			_, err = s.Load(ctx, "b")
+			require.NoError(t, err)
+
+			// Deleting a user removes all of its sessions
+			require.NoError(t, s.DeleteUser(ctx, "google", "1"))
+			_, err = s.Load(ctx, "b")
+			require.ErrorIs(t, err, ErrSessionNotFound)
+			_, err = s.Load(ctx, "c")
+			require.NoError(t, err)
+			require.NoError(t, s.DeleteUser(ctx, "google", "1"))
+		})
+	}
+}
+
+func TestStoreExpiration(t *testing.T) {
+	ctx := context.Background()
+	stores, mr := testStores(t)
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, s.Save(ctx, "a", Data{ID: "1", Provider: "Google"}, 50*time.Millisecond))
+			_, err := s.Load(ctx, "a")
+			require.NoError(t, err)
+
+			time.Sleep(100 * time.Millisecond)
+			mr.FastForward(100 * time.Millisecond)
+			_, err = s.Load(ctx, "a")
+			require.ErrorIs(t, err, ErrSessionNotFound)
+		})
+	}
+}
+
+func TestStoreRevocation(t *testing.T) {
+	ctx := context.Background()
+	stores, mr := testStores(t)
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			// refreshing an older session close to its lifetime does not shorten the index of the sessions of the user
+			require.NoError(t, s.Save(ctx, "new", Data{ID: "1", Provider: "Google"}, time.Hour))
+			require.NoError(t, s.Save(ctx, "old", Data{ID: "1", Provider: "Google"}, 50*time.Millisecond))
+
+			// Redis rounds the TTL of the index up to a second
+			time.Sleep(100 * time.Millisecond)
+			mr.FastForward(2 * time.Second)
+			_, err := s.Load(ctx, "new")
+			require.NoError(t, err)
+
+			require.NoError(t, s.DeleteUser(ctx, "google", "1"))
+			_, err = s.Load(ctx, "new")
+			require.ErrorIs(t, err, ErrSessionNotFound)
+		})
+	}
+}
+
+func TestBoltStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Save(ctx, "a", Data{ID: "1", Provider: "Google"}, time.Hour))
+	require.NoError(t, s.Save(ctx, "b", Data{ID: "1", Provider: "Google"}, 50*time.Millisecond))
+	require.NoError(t, s.Save(ctx, "c", Data{ID: "2", Provider: "Google"}, 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, s.Close())
+
+	// expired sessions are deleted when the file is opened, even if they are never read again
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		require.NotNil(t, sessions.Get([]byte("a")))
+		require.Nil(t, sessions.Get([]byte("b")))
+		require.Nil(t, sessions.Get([]byte("c")))
+
+		users := tx.Bucket(usersBucket)
+		require.NotNil(t, users.Bucket([]byte("google:1")).Get([]byte("a")))
+		require.Nil(t, users.Bucket([]byte("google:1")).Get([]byte("b")))
+		require.Nil(t, users.Bucket([]byte("google:2")))
+		return nil
+	}))
+
+	// and periodically while it is open
+	require.NoError(t, s.sweep(time.Now().Add(2*time.Hour)))
+	require.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket(sessionsBucket).Get([]byte("a")))
+		require.Nil(t, tx.Bucket(usersBucket).Bucket([]byte("google:1")))
+		return nil
+	}))
+}
+
+func TestManagerStore(t *testing.T) {
+	sm := NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L")
+	sm.SetStore(NewMemoryStore())
+
+	res := httptest.NewRecorder()
+	require.NoError(t, sm.AttachSession(res, httptest.NewRequest("GET", "/", nil), Data{ID: "1", Provider: "Google", Name: "test"}))
+	cookies := res.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	// The cookie holds only the session ID
+	id, err := sm.ReadSessionCookie(cookies[0], sm.cookieSeed, sm.cookieKeys[0])
+	require.NoError(t, err)
+	require.NotContains(t, id, "test")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	d, err := sm.ReadSession(req)
+	require.NoError(t, err)
+	require.Equal(t, "test", d.Name)
+	require.Equal(t, id, d.SessionID)
+
+	// Renewed sessions get a new ID, and the old one can not be used
+	res = httptest.NewRecorder()
+	require.NoError(t, sm.RenewSession(res, req, *d))
+	renewed := httptest.NewRequest("GET", "/", nil)
+	renewed.AddCookie(res.Result().Cookies()[0])
+	d, err = sm.ReadSession(renewed)
+	require.NoError(t, err)
+	require.Equal(t, "test", d.Name)
+	require.NotEqual(t, id, d.SessionID)
+	_, err = sm.ReadSession(req)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+	req = renewed
+
+	// Revoked sessions can not be used, even with a valid cookie
+	require.NoError(t, sm.RevokeUser(context.Background(), "Google", "1"))
+	_, err = sm.ReadSession(req)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+
+	require.Error(t, NewManager("0123456789abcdefghijklmnopqrstuv", "2345asdYDS!2012L").RevokeUser(context.Background(), "Google", "1"))
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func IsEnvSet(key string) bool {
@@ -28,6 +30,27 @@ func GetStringEnvWithDefault(key, fallback string) string {
 	return fallback
 }
 
+// GetStringListEnv returns the comma separated values of the environment variable, or nil if it is not set. Values
+// separated by semicolons can contain commas, such as LDAP DNs.
+func GetStringListEnv(key string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+
+	separator := ","
+	if strings.Contains(value, ";") {
+		separator = ";"
+	}
+	var list []string
+	for _, v := range strings.Split(value, separator) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func GetIntEnv(key string) (int, error) {
 	if value, ok := os.LookupEnv(key); ok {
 		if i, err := strconv.Atoi(value); err != nil {
@@ -50,6 +73,29 @@ func GetIntEnvWithDefault(key string, fallback int) int {
 	return fallback
 }
 
+func GetBoolEnvWithDefault(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err != nil {
+			return fallback
+		} else {
+			return b
+		}
+	}
+	return fallback
+}
+
+// GetDurationEnvWithDefault reads a duration such as "30m" or "720h", falling back if it is not set or invalid
+func GetDurationEnvWithDefault(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err != nil {
+			return fallback
+		} else {
+			return d
+		}
+	}
+	return fallback
+}
+
 func HandleError(err error, fatal bool, msg string, args ...interface{}) string {
 	if err != nil {
 		pc, filename, line, _ := runtime.Caller(1)
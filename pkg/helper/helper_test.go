@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGetIntEnv(t *testing.T) {
@@ -27,6 +28,42 @@ func TestGetStringEnv(t *testing.T) {
 	}
 }
 
+func TestGetStringListEnv(t *testing.T) {
+	_ = os.Setenv("TEST_LIST", "a, b,,c ")
+
+	// Test
+	got := GetStringListEnv("TEST_LIST")
+	require.Equal(t, []string{"a", "b", "c"}, got)
+
+	_ = os.Setenv("TEST_LIST", "ldap:cn=a,dc=org; github:b;")
+	require.Equal(t, []string{"ldap:cn=a,dc=org", "github:b"}, GetStringListEnv("TEST_LIST"))
+
+	_ = os.Unsetenv("TEST_LIST")
+	require.Nil(t, GetStringListEnv("TEST_LIST"))
+}
+
+func TestGetBoolEnvWithDefault(t *testing.T) {
+	_ = os.Setenv("TEST_BOOL", "true")
+	require.True(t, GetBoolEnvWithDefault("TEST_BOOL", false))
+
+	_ = os.Setenv("TEST_BOOL", "yes please")
+	require.False(t, GetBoolEnvWithDefault("TEST_BOOL", false))
+
+	_ = os.Unsetenv("TEST_BOOL")
+	require.True(t, GetBoolEnvWithDefault("TEST_BOOL", true))
+}
+
+func TestGetDurationEnvWithDefault(t *testing.T) {
+	_ = os.Setenv("TEST_DURATION", "90m")
+	require.Equal(t, 90*time.Minute, GetDurationEnvWithDefault("TEST_DURATION", time.Hour))
+
+	_ = os.Setenv("TEST_DURATION", "90")
+	require.Equal(t, time.Hour, GetDurationEnvWithDefault("TEST_DURATION", time.Hour))
+
+	_ = os.Unsetenv("TEST_DURATION")
+	require.Equal(t, time.Hour, GetDurationEnvWithDefault("TEST_DURATION", time.Hour))
+}
+
 func TestIsEnvSet(t *testing.T) {
 	_ = os.Setenv("TEST_STRING", "123")
 
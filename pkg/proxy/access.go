@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/habakke/auth-proxy/internal/access"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetAccessStore enables the access request workflow, where users must be approved by an admin before they
+// reach the upstream. Without a store all authenticated users are authorized.
+func (p *Proxy) SetAccessStore(store access.Store) {
+	p.accessStore = store
+}
+
+// SetAdmins sets the users allowed to approve and deny access requests, by verified email address or group, which
+// may be qualified with its provider as in the policy
+func (p *Proxy) SetAdmins(emails []string, groups []string) {
+	p.adminEmails = emails
+	p.adminGroups = groups
+}
+
+func (p *Proxy) isAdmin(s *session.Data) bool {
+	if s.EmailVerified {
+		for _, email := range p.adminEmails {
+			if strings.EqualFold(email, s.Email) {
+				return true
+			}
+		}
+	}
+	return s.MemberOf(p.adminGroups...)
+}
+
+// checkAccess sets the Authorized flag of the session from the decision on the access request of the user.
+// Local users and admins are always authorized.
+func (p *Proxy) checkAccess(s *session.Data) {
+	if p.accessStore == nil || p.isLocalSession(s) || p.isAdmin(s) {
+		s.Authorized = true
+		return
+	}
+
+	r, err := p.accessStore.Get(access.RequestID(s.Provider, s.ID))
+	if err != nil {
+		if !errors.Is(err, access.ErrNotFound) {
+			log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to read access request")
+		}
+		s.Authorized = false
+		return
+	}
+	s.Authorized = r.Status == access.Approved
+}
+
+// requestAccess stores an access request for the user unless it already has one, and authorizes the session
+func (p *Proxy) requestAccess(s *session.Data) error {
+	if p.accessStore != nil && !p.isAdmin(s) {
+		r, err := p.accessStore.Request(access.Request{
+			ID:       access.RequestID(s.Provider, s.ID),
+			Provider: s.Provider,
+			UserID:   s.ID,
+			Email:    s.Email,
+			Name:     s.Name,
+		})
+		if err != nil {
+			return err
+		}
+		if r.Status == access.Pending {
+			log.Info().Str("id", s.ID).Str("email", s.Email).Str("provider", s.Provider).Msg("access requested")
+		}
+	}
+
+	p.checkAccess(s)
+	return nil
+}
+
+// PendingPage tells users waiting for approval that their request is pending, or that it has been denied
+func (p *Proxy) PendingPage(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Redirect(res, req, p.loginPath, http.StatusFound)
+		return
+	}
+	p.checkAccess(s)
+	if s.Authorized {
+		http.Redirect(res, req, "/", http.StatusFound)
+		return
+	}
+
+	denied := false
+	if r, err := p.accessStore.Get(access.RequestID(s.Provider, s.ID)); err == nil {
+		denied = r.Status == access.Denied
+	}
+
+	name := "pending.tpl"
+	data := struct {
+		Email      string
+		Denied     bool
+		LogoutPath string
+		StaticPath string
+	}{
+		Email:      s.Email,
+		Denied:     denied,
+		LogoutPath: p.logoutPath,
+		StaticPath: p.staticPath,
+	}
+	_ = p.getTemplate(name).ExecuteTemplate(res, name, data)
+}
+
+// sameOrigin returns true unless the browser reports, in the Origin or else the Referer header, that the request was
+// sent from another site. Requests without either header, as sent by API clients, are not rejected.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Referer()
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// isJSON returns true for requests with a JSON body, which browsers only send across sites after a CORS preflight
+// the proxy never allows
+func isJSON(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+}
+
+// verifyAdminPost returns true for API requests with a JSON body, and for forms of the admin page carrying its CSRF
+// token. Forms can be posted from any site, and browsers do not always send the Origin header.
+func (p *Proxy) verifyAdminPost(req *http.Request) bool {
+	if !sameOrigin(req) {
+		return false
+	}
+	return isJSON(req) || p.sessionManager.VerifyCSRFToken(req, req.FormValue("csrf_token"))
+}
+
+// Admin serves the admin page and API for deciding access requests
+func (p *Proxy) Admin(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Redirect(res, req, p.loginURL(req.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	if !p.isAdmin(s) {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	requestsPath := p.adminPath + "/requests"
+	sessionsPath := p.adminPath + "/sessions"
+	cleanPath := strings.TrimSuffix(req.URL.Path, "/")
+	if cleanPath == sessionsPath && req.Method == "POST" {
+		if !sameOrigin(req) || !isJSON(req) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p.revokeSessions(res, req, s)
+		return
+	}
+	if p.accessStore == nil {
+		http.NotFound(res, req)
+		return
+	}
+
+	switch {
+	case cleanPath == p.adminPath && req.Method == "GET":
+		p.adminPage(res, req, requestsPath)
+	case cleanPath == requestsPath && req.Method == "GET":
+		p.listAccessRequests(res)
+	case cleanPath == requestsPath && req.Method == "POST":
+		if !p.verifyAdminPost(req) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p.decideAccessRequest(res, req, s)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+func (p *Proxy) adminPage(res http.ResponseWriter, req *http.Request, requestsPath string) {
+	requests, err := p.accessStore.List()
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to list access requests")
+		errorHandler(res, req, "failed to list access requests")
+		return
+	}
+
+	csrfToken, err := p.sessionManager.AttachCSRFToken(res)
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to create csrf token")
+		errorHandler(res, req, "failed to create admin page")
+		return
+	}
+
+	name := "admin.tpl"
+	data := struct {
+		Requests     []access.Request
+		RequestsPath string
+		CSRFToken    string
+		LogoutPath   string
+		StaticPath   string
+	}{
+		Requests:     requests,
+		RequestsPath: requestsPath,
+		CSRFToken:    csrfToken,
+		LogoutPath:   p.logoutPath,
+		StaticPath:   p.staticPath,
+	}
+	_ = p.getTemplate(name).ExecuteTemplate(res, name, data)
+}
+
+func (p *Proxy) listAccessRequests(res http.ResponseWriter) {
+	requests, err := p.accessStore.List()
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to list access requests")
+		http.Error(res, "failed to list access requests", http.StatusInternalServerError)
+		return
+	}
+	if requests == nil {
+		requests = []access.Request{}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(requests)
+}
+
+// decideAccessRequest sets the status of the request from a form or JSON body with the fields id and status.
+// Forms are redirected back to the admin page, while API clients get the updated request.
+func (p *Proxy) decideAccessRequest(res http.ResponseWriter, req *http.Request, admin *session.Data) {
+	decision := struct {
+		ID     string        `json:"id"`
+		Status access.Status `json:"status"`
+	}{}
+	isForm := !isJSON(req)
+	if isForm {
+		decision.ID = req.FormValue("id")
+		decision.Status = access.Status(req.FormValue("status"))
+	} else if err := json.NewDecoder(req.Body).Decode(&decision); err != nil {
+		http.Error(res, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !access.ValidStatus(decision.Status) {
+		http.Error(res, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	decidedBy := admin.Email
+	if decidedBy == "" {
+		decidedBy = access.RequestID(admin.Provider, admin.ID)
+	}
+	r, err := p.accessStore.Decide(decision.ID, decision.Status, decidedBy)
+	if errors.Is(err, access.ErrNotFound) {
+		http.NotFound(res, req)
+		return
+	} else if err != nil {
+		log.Error().AnErr("err", err).Str("request", decision.ID).Msg("failed to decide access request")
+		http.Error(res, "failed to decide access request", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("request", r.ID).Str("status", string(r.Status)).Str("admin", decidedBy).Msg("access request decided")
+
+	if isForm {
+		http.Redirect(res, req, p.adminPath, http.StatusSeeOther)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(r)
+}
+
+// revokeSessions deletes all sessions of the user given by a JSON body with the fields provider and user_id,
+// signing the user out everywhere. It requires a session store.
+func (p *Proxy) revokeSessions(res http.ResponseWriter, req *http.Request, admin *session.Data) {
+	if !p.sessionManager.HasStore() {
+		http.NotFound(res, req)
+		return
+	}
+
+	user := struct {
+		Provider string `json:"provider"`
+		UserID   string `json:"user_id"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&user); err != nil || user.Provider == "" || user.UserID == "" {
+		http.Error(res, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.sessionManager.RevokeUser(req.Context(), user.Provider, user.UserID); err != nil {
+		log.Error().AnErr("err", err).Str("user", session.UserKey(user.Provider, user.UserID)).Msg("failed to revoke sessions")
+		http.Error(res, "failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("user", session.UserKey(user.Provider, user.UserID)).Str("admin", admin.Email).Msg("sessions revoked")
+	res.WriteHeader(http.StatusNoContent)
+}
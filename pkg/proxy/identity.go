@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/habakke/auth-proxy/internal/assertion"
+	"github.com/habakke/auth-proxy/internal/session"
+	"net/http"
+	"strings"
+)
+
+// DefaultAssertionHeader is the header the signed identity assertion is sent to the upstream in by default
+const DefaultAssertionHeader = "X-Forwarded-Jwt-Assertion"
+
+// IdentityHeaders are the names of the headers the identity of the user is sent in. Headers with an empty
+// name are not sent.
+type IdentityHeaders struct {
+	User     string
+	Email    string
+	Name     string
+	Groups   string
+	Provider string
+}
+
+// DefaultIdentityHeaders returns the headers the identity of the user is sent to the upstream in by default
+func DefaultIdentityHeaders() IdentityHeaders {
+	return IdentityHeaders{
+		User:     "X-Forwarded-User",
+		Email:    "X-Forwarded-Email",
+		Name:     "X-Forwarded-Name",
+		Groups:   "X-Forwarded-Groups",
+		Provider: "X-Forwarded-Provider",
+	}
+}
+
+// verifyIdentityHeaders are the headers the verify endpoint answers with
+var verifyIdentityHeaders = IdentityHeaders{
+	User:     "X-Auth-Request-User",
+	Email:    "X-Auth-Request-Email",
+	Name:     "X-Auth-Request-Name",
+	Groups:   "X-Auth-Request-Groups",
+	Provider: "X-Auth-Request-Provider",
+}
+
+func (i IdentityHeaders) names() []string {
+	return []string{i.User, i.Email, i.Name, i.Groups, i.Provider}
+}
+
+// Strip removes the identity headers, so they can not be spoofed by the client
+func (i IdentityHeaders) Strip(h http.Header) {
+	for _, name := range i.names() {
+		if name != "" {
+			delHeader(h, name)
+		}
+	}
+}
+
+// delHeader removes the header, including variants spelled with underscores instead of dashes, which some
+// upstreams (CGI, PHP, WSGI, nginx with underscores_in_headers) can not tell apart from the header
+func delHeader(h http.Header, name string) {
+	h.Del(name)
+	for k := range h {
+		if strings.EqualFold(strings.ReplaceAll(k, "_", "-"), name) {
+			delete(h, k)
+		}
+	}
+}
+
+// Set replaces the identity headers with the identity of the session
+func (i IdentityHeaders) Set(h http.Header, s *session.Data) {
+	values := []string{s.ID, s.Email, s.Name, strings.Join(s.Groups, ","), s.Provider}
+	for n, name := range i.names() {
+		if name != "" {
+			h.Set(name, values[n])
+		}
+	}
+}
+
+// SetIdentityAssertion makes the proxy send a JWT signed by the signer, asserting the identity of the user, to the
+// upstream in the header. The upstream verifies it with the keys published on the JWKS endpoint.
+func (p *Proxy) SetIdentityAssertion(signer *assertion.Signer, header string) {
+	p.assertionSigner = signer
+	p.assertionHeader = header
+}
+
+// setIdentityAssertion replaces the assertion header with an assertion of the identity of the session
+func (p *Proxy) setIdentityAssertion(h http.Header, s *session.Data) error {
+	if p.assertionSigner == nil {
+		return nil
+	}
+
+	delHeader(h, p.assertionHeader)
+	if s == nil {
+		return nil
+	}
+	token, err := p.assertionSigner.Sign(s)
+	if err != nil {
+		return err
+	}
+	h.Set(p.assertionHeader, token)
+	return nil
+}
+
+// JWKS publishes the keys the identity assertions are signed with
+func (p *Proxy) JWKS(res http.ResponseWriter, req *http.Request) {
+	if p.assertionSigner == nil {
+		http.NotFound(res, req)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "public, max-age=3600")
+	_ = json.NewEncoder(res).Encode(p.assertionSigner.JWKS())
+}
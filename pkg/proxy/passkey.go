@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/habakke/auth-proxy/internal/auth"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+)
+
+// Passkey serves the page where signed in users add passkeys, and the JSON API of the registration and login
+// ceremonies, which is called by the script of the pages
+func (p *Proxy) Passkey(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	cleanPath := strings.TrimSuffix(req.URL.Path, "/")
+	if cleanPath == p.passkeyPath && req.Method == "GET" {
+		p.passkeyPage(res, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.NotFound(res, req)
+		return
+	}
+	// browsers only send JSON from other sites after a CORS preflight, which is never answered
+	if !sameOrigin(req) || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch strings.TrimPrefix(cleanPath, p.passkeyPath) {
+	case "/login/begin":
+		p.beginPasskeyLogin(res)
+	case "/login/finish":
+		p.finishPasskeyLogin(res, req)
+	case "/register/begin":
+		p.beginPasskeyRegistration(res, req)
+	case "/register/finish":
+		p.finishPasskeyRegistration(res, req)
+	case "/remove":
+		p.removePasskeys(res, req)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_ = json.NewEncoder(res).Encode(v)
+}
+
+func (p *Proxy) passkeyPage(res http.ResponseWriter, req *http.Request) {
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Redirect(res, req, p.loginURL(req.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	credentials, err := p.passkeys.Credentials(s)
+	if err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to read passkeys")
+		errorHandler(res, req, "failed to read passkeys")
+		return
+	}
+
+	name := "passkey.tpl"
+	data := struct {
+		Email       string
+		Passkeys    int
+		Available   bool
+		PasskeyPath string
+		LogoutPath  string
+		StaticPath  string
+	}{
+		Email:       s.Email,
+		Passkeys:    len(credentials),
+		Available:   p.isLocalSession(s),
+		PasskeyPath: p.passkeyPath,
+		LogoutPath:  p.logoutPath,
+		StaticPath:  p.staticPath,
+	}
+	_ = p.getTemplate(name).ExecuteTemplate(res, name, data)
+}
+
+func (p *Proxy) beginPasskeyRegistration(res http.ResponseWriter, req *http.Request) {
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !p.isLocalSession(s) {
+		http.Error(res, "passkeys are only available to users of the login form", http.StatusForbidden)
+		return
+	}
+
+	options, state, err := p.passkeys.BeginRegistration(s)
+	if err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to begin passkey registration")
+		http.Error(res, "failed to begin passkey registration", http.StatusInternalServerError)
+		return
+	}
+	if err := p.sessionManager.AttachPasskeyState(res, state); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach passkey state")
+		http.Error(res, "failed to begin passkey registration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, options)
+}
+
+func (p *Proxy) finishPasskeyRegistration(res http.ResponseWriter, req *http.Request) {
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !p.isLocalSession(s) {
+		http.Error(res, "passkeys are only available to users of the login form", http.StatusForbidden)
+		return
+	}
+
+	// the challenge can only be answered once
+	state := webauthn.SessionData{}
+	stateErr := p.sessionManager.ReadPasskeyState(req, &state)
+	p.sessionManager.RemovePasskeyState(res)
+	if stateErr != nil {
+		http.Error(res, "passkey registration has expired", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := p.passkeys.FinishRegistration(s, state, req.Body); err != nil {
+		log.Info().AnErr("err", err).Str("id", s.ID).Msg("passkey registration rejected")
+		http.Error(res, "passkey was not accepted", http.StatusBadRequest)
+		return
+	}
+	log.Info().Str("id", s.ID).Str("provider", s.Provider).Msg("passkey registered")
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) removePasskeys(res http.ResponseWriter, req *http.Request) {
+	s, ok := p.authenticatedSession(req)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := p.passkeys.Remove(s); err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to remove passkeys")
+		http.Error(res, "failed to remove passkeys", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("id", s.ID).Str("provider", s.Provider).Msg("passkeys removed")
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) beginPasskeyLogin(res http.ResponseWriter) {
+	options, state, err := p.passkeys.BeginLogin()
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to begin passkey login")
+		http.Error(res, "failed to begin passkey login", http.StatusInternalServerError)
+		return
+	}
+	if err := p.sessionManager.AttachPasskeyState(res, state); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach passkey state")
+		http.Error(res, "failed to begin passkey login", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, options)
+}
+
+// finishPasskeyLogin verifies the assertion, and signs the user in to the account the passkey was registered for,
+// with the profile looked up in the login backend again. The response tells the script of the login page where to
+// send the user, which is the login page showing an error if the passkey was not accepted.
+func (p *Proxy) finishPasskeyLogin(res http.ResponseWriter, req *http.Request) {
+	redirect := p.redirectURL(req, req.URL.Query().Get("p"))
+	reject := func() {
+		writeJSON(res, http.StatusUnauthorized, map[string]string{"redirect": p.loginErrorURL(redirect, loginErrorPasskey)})
+	}
+
+	// the challenge can only be answered once
+	state := webauthn.SessionData{}
+	stateErr := p.sessionManager.ReadPasskeyState(req, &state)
+	p.sessionManager.RemovePasskeyState(res)
+	if stateErr != nil {
+		writeJSON(res, http.StatusUnauthorized, map[string]string{"redirect": p.loginErrorURL(redirect, loginErrorExpired)})
+		return
+	}
+
+	u, err := p.passkeys.FinishLogin(state, req.Body)
+	if errors.Is(err, auth.ErrPasskeyCloned) {
+		log.Warn().Str("user", u.Key()).Msg("passkey login rejected, sign counter did not increase")
+		reject()
+		return
+	} else if err != nil {
+		log.Info().AnErr("err", err).Msg("passkey login rejected")
+		reject()
+		return
+	}
+
+	// the passkey requires user verification, so it is a second factor of its own. Only users of the login form have
+	// passkeys, as only they can be looked up again without the provider, and acceptsSession gives the session the
+	// current profile of the user.
+	s := u.Session()
+	if !p.isLocalSession(&s) || !p.acceptsSession(&s) {
+		log.Info().Str("id", s.ID).Str("provider", s.Provider).Msg("passkey login rejected, user is no longer allowed to log in")
+		reject()
+		return
+	}
+	s.Authorized = true
+	if err := p.sessionManager.AttachSession(res, req, s); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach session")
+		http.Error(res, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	log.Debug().Str("id", s.ID).Str("provider", s.Provider).Msg("user logged in with passkey")
+
+	writeJSON(res, http.StatusOK, map[string]string{"redirect": redirect})
+}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"crypto/subtle"
 	"embed"
 	"fmt"
+	"github.com/habakke/auth-proxy/internal/access"
+	"github.com/habakke/auth-proxy/internal/assertion"
 	"github.com/habakke/auth-proxy/internal/auth"
 	"github.com/habakke/auth-proxy/internal/auth/providers"
-	"github.com/habakke/auth-proxy/internal/cookie"
+	"github.com/habakke/auth-proxy/internal/policy"
 	"github.com/habakke/auth-proxy/internal/session"
 	"github.com/habakke/auth-proxy/pkg/helper"
 	"github.com/habakke/auth-proxy/pkg/util"
@@ -17,7 +20,6 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"path"
-	"regexp"
 	"strings"
 )
 
@@ -27,34 +29,57 @@ type Proxy struct {
 	headers           map[string]string
 	authorizedHeaders map[string]string
 
-	localAuth *auth.LocalAuth
-	provider  providers.Provider
-
-	pathWhiteList   []*regexp.Regexp
-	domainWhiteList []*regexp.Regexp
-	errorPath       string
-	loginPath       string
-	logoutPath      string
-	staticPath      string
-	resetPath       string
-	signupPath      string
+	localAuth auth.Authenticator
+	totp      *auth.TOTP
+	passkeys  *auth.Passkeys
+	providers []providers.Provider
+
+	errorPath   string
+	loginPath   string
+	logoutPath  string
+	staticPath  string
+	resetPath   string
+	signupPath  string
+	verifyPath  string
+	totpPath    string
+	passkeyPath string
+	pendingPath string
+	adminPath   string
+	jwksPath    string
+
+	allowedRedirectHosts []string
+	identityHeaders      IdentityHeaders
+	assertionSigner      *assertion.Signer
+	assertionHeader      string
+	policy               *policy.Policy
+	accessStore          access.Store
+	adminEmails          []string
+	adminGroups          []string
+	verifyRedirect       bool
 
 	sessionManager *session.Manager
 }
 
-func NewProxy(target string, provider providers.Provider, sessionManager *session.Manager) *Proxy {
+func NewProxy(target string, providers []providers.Provider, sessionManager *session.Manager) *Proxy {
 	return &Proxy{
 		Target:            target,
 		headers:           make(map[string]string),
 		authorizedHeaders: make(map[string]string),
-		provider:          provider,
+		providers:         providers,
 		localAuth:         auth.NewAuthLocal(),
 		errorPath:         "/auth/error",
 		loginPath:         "/auth/login",
 		logoutPath:        "/auth/logout",
 		resetPath:         "/auth/reset",
 		signupPath:        "/auth/signup",
+		verifyPath:        "/auth/verify",
+		totpPath:          "/auth/totp",
+		passkeyPath:       "/auth/passkey",
+		pendingPath:       "/auth/pending",
+		adminPath:         "/auth/admin",
+		jwksPath:          "/auth/.well-known/jwks.json",
 		staticPath:        "/static",
+		identityHeaders:   DefaultIdentityHeaders(),
 
 		sessionManager: sessionManager,
 	}
@@ -76,10 +101,32 @@ func (p *Proxy) SetStaticPath(staticPath string) {
 	p.errorPath = staticPath
 }
 
-func (p *Proxy) SetLocalAuth(localAuth *auth.LocalAuth) {
+// SetLocalAuth sets the backend checking the credentials of the login form, such as htpasswd users or LDAP
+func (p *Proxy) SetLocalAuth(localAuth auth.Authenticator) {
 	p.localAuth = localAuth
 }
 
+// SetTOTP requires users of the login form to enter a code from an authenticator app after the password, and to
+// enrol on their first login
+func (p *Proxy) SetTOTP(totp *auth.TOTP) {
+	p.totp = totp
+}
+
+// SetPasskeys lets signed in users register passkeys, and sign in with them from the login page without a password
+func (p *Proxy) SetPasskeys(passkeys *auth.Passkeys) {
+	p.passkeys = passkeys
+}
+
+// SetIdentityHeaders sets the headers the identity of the user is sent to the upstream in
+func (p *Proxy) SetIdentityHeaders(headers IdentityHeaders) {
+	p.identityHeaders = headers
+}
+
+// SetPolicy sets the rules deciding which requests require authentication, and who they are allowed for
+func (p *Proxy) SetPolicy(policy *policy.Policy) {
+	p.policy = policy
+}
+
 func (p *Proxy) AddHeaderToUpstreamRequests(key string, value string) {
 	p.headers[key] = value
 }
@@ -100,33 +147,108 @@ func (p *Proxy) getProxyURL() string {
 	return p.Target
 }
 
+// getProvider returns the provider with the given name. Sessions created before the provider was
+// recorded in the session belong to the first provider.
+func (p *Proxy) getProvider(name string) (providers.Provider, bool) {
+	if name == "" && len(p.providers) > 0 {
+		return p.providers[0], true
+	}
+	for _, provider := range p.providers {
+		if strings.EqualFold(provider.Data().Name, name) {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
 func (p *Proxy) Authenticate(req *http.Request) bool {
+	_, ok := p.authenticatedSession(req)
+	return ok
+}
+
+// authenticatedSession returns the session of the request, and whether it is still accepted by its provider
+func (p *Proxy) authenticatedSession(req *http.Request) (*session.Data, bool) {
 	s, err := p.sessionManager.ReadSession(req)
 	if err != nil {
-		return false
+		return nil, false
 	}
 
-	return p.provider.AuthenticateSession(s)
+	if s.SecondFactorPending {
+		return s, false
+	}
+	return s, p.acceptsSession(s)
 }
 
-func (p Proxy) IsWhitelistRequest(req *http.Request) bool {
-	return req.Method == "OPTIONS" || p.IsWhitelistedPath(req.URL.Path) || p.IsWhitelistedDomain(req.URL.Host)
+// acceptsSession returns true for sessions still accepted by their provider. Sessions of the login form are accepted
+// while the user exists in the backend, and get the current email, name and groups of the user.
+func (p *Proxy) acceptsSession(s *session.Data) bool {
+	if p.isLocalSession(s) {
+		u, ok := p.localAuth.Lookup(s.ID)
+		if !ok {
+			log.Debug().Str("id", s.ID).Str("provider", s.Provider).Msg("session user no longer exists")
+			return false
+		}
+		s.Email = u.GetEmail()
+		s.Name = u.GetName()
+		s.Groups = u.GetGroups()
+		return true
+	}
+	provider, ok := p.getProvider(s.Provider)
+	if !ok {
+		log.Debug().Str("id", s.ID).Str("provider", s.Provider).Msg("session provider is not configured")
+		return false
+	}
+	return provider.AuthenticateSession(s)
 }
 
-func (p Proxy) IsWhitelistedPath(path string) bool {
-	for _, u := range p.pathWhiteList {
-		ok := u.MatchString(path)
-		return ok
-	}
-	return false
+// isLocalSession returns true for sessions created by the login form with the configured backend
+func (p *Proxy) isLocalSession(s *session.Data) bool {
+	return p.localAuth != nil && s.Provider == p.localAuth.Name()
 }
 
-func (p Proxy) IsWhitelistedDomain(domain string) bool {
-	for _, d := range p.domainWhiteList {
-		ok := d.MatchString(domain)
-		return ok
+type decision int
+
+const (
+	decisionAllow decision = iota
+	decisionLogin
+	decisionPending
+	decisionForbidden
+)
+
+// authorize applies the policy rule matching the request, and returns the decision together with the session,
+// which is nil for anonymous requests
+func (p *Proxy) authorize(req *http.Request) (*session.Data, decision) {
+	rule := p.policy.Match(req)
+
+	var s *session.Data
+	if rule.Action != policy.Deny {
+		if authenticated, ok := p.authenticatedSession(req); ok {
+			s = authenticated
+			p.checkAccess(s)
+		}
+	}
+
+	d := decisionAllow
+	switch {
+	case s != nil && !s.Authorized && rule.Action == policy.AllowAnonymous:
+		// Users waiting for approval are anonymous
+		s = nil
+	case s != nil && !s.Authorized:
+		d = decisionPending
+	case rule.Allows(s):
+	case s == nil && rule.Action != policy.Deny:
+		d = decisionLogin
+	default:
+		d = decisionForbidden
+	}
+
+	e := log.Debug().Str("method", req.Method).Str("host", req.Host).Str("path", req.URL.Path).
+		Str("rule", rule.Name).Str("action", string(rule.Action))
+	if s != nil {
+		e = e.Str("id", s.ID).Str("provider", s.Provider)
 	}
-	return false
+	e.Bool("allowed", d == decisionAllow).Msg("policy decision")
+	return s, d
 }
 
 // handle error and redirect to error page
@@ -134,11 +256,21 @@ func errorHandler(res http.ResponseWriter, req *http.Request, errMsg string) {
 	http.Redirect(res, req, fmt.Sprintf("/auth/error?error=%s", util.Base64Encode([]byte(errMsg))), http.StatusTemporaryRedirect)
 }
 
-// Serve a reverse proxy for a given url
-func (p *Proxy) serveReverseProxy(target string, authenticated bool, res http.ResponseWriter, req *http.Request) {
+// Serve a reverse proxy for a given url, with the identity of the session if it is set
+func (p *Proxy) serveReverseProxy(target string, authenticated bool, s *session.Data, res http.ResponseWriter, req *http.Request) {
 	// parse the url
 	u, _ := url.Parse(target)
 
+	p.identityHeaders.Strip(req.Header)
+	if s != nil {
+		p.identityHeaders.Set(req.Header, s)
+	}
+	if err := p.setIdentityAssertion(req.Header, s); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to sign identity assertion")
+		errorHandler(res, req, "failed to sign identity assertion")
+		return
+	}
+
 	for k, v := range p.headers {
 		req.Header.Add(k, v)
 	}
@@ -181,29 +313,71 @@ func (p *Proxy) LocalAuth(req *http.Request) (providers.User, bool) {
 }
 
 func (p *Proxy) Login(res http.ResponseWriter, req *http.Request) {
-	// First try local authentication
+	redirect := p.redirectURL(req, req.FormValue("p"))
+	if !p.sessionManager.VerifyCSRFToken(req, req.FormValue("csrf_token")) {
+		log.Info().Msg("login rejected, invalid csrf token")
+		http.Redirect(res, req, p.loginErrorURL(redirect, loginErrorExpired), http.StatusSeeOther)
+		return
+	}
+
 	user, ok := p.LocalAuth(req)
-	if ok {
-		sd := session.Data{
-			ID:         user.GetID(),
-			Authorized: false,
-		}
-		_ = p.sessionManager.AttachSession(res, sd)
-		http.Redirect(res, req, "/", http.StatusFound)
+	if !ok {
+		log.Info().Str("username", req.FormValue("username")).Msg("login rejected, invalid credentials")
+		http.Redirect(res, req, p.loginErrorURL(redirect, loginErrorInvalid), http.StatusSeeOther)
+		return
 	}
 
+	sd := session.Data{
+		ID:         user.GetID(),
+		Email:      user.GetEmail(),
+		Name:       user.GetName(),
+		Groups:     user.GetGroups(),
+		Provider:   p.localAuth.Name(),
+		Authorized: true,
+		// the session is not authenticated until the code from the authenticator app is entered
+		SecondFactorPending: p.totp != nil,
+	}
+	if err := p.sessionManager.AttachSession(res, req, sd); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach session")
+		errorHandler(res, req, "failed to create session")
+		return
+	}
+	p.sessionManager.RemoveCSRFToken(res)
+	if sd.SecondFactorPending {
+		http.Redirect(res, req, p.totpURL(redirect, ""), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(res, req, redirect, http.StatusSeeOther)
+}
+
+func (p *Proxy) ProviderLogin(provider providers.Provider, res http.ResponseWriter, req *http.Request) {
+	state, err := session.NewLoginState()
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to generate login state")
+		errorHandler(res, req, "failed to generate Oauth2 authentication link")
+		return
+	}
+	state.Redirect = p.redirectURL(req, req.URL.Query().Get("p"))
+
 	// Start Provider Oauth2 authentication
-	u, err := p.provider.GetProviderLoginURL(res)
+	u, err := provider.GetProviderLoginURL(state)
 	if err != nil {
 		errorHandler(res, req, "failed to generate Oauth2 authentication link")
 		return
 	}
+	if err := p.sessionManager.AttachLoginState(res, *state); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach login state")
+		errorHandler(res, req, "failed to generate Oauth2 authentication link")
+		return
+	}
 
 	http.Redirect(res, req, u.String(), http.StatusFound)
 }
 
-func (p *Proxy) OauthCallback(res http.ResponseWriter, req *http.Request) {
-	csrf, _ := req.Cookie(cookie.CSRFCookieName)
+func (p *Proxy) OauthCallback(provider providers.Provider, res http.ResponseWriter, req *http.Request) {
+	// The login state can only be used once
+	state, stateErr := p.sessionManager.ReadLoginState(req)
+	p.sessionManager.RemoveLoginState(res)
 
 	// Do some sanity checking
 	err := req.ParseForm()
@@ -216,39 +390,63 @@ func (p *Proxy) OauthCallback(res http.ResponseWriter, req *http.Request) {
 		errorHandler(res, req, fmt.Sprintf("Permission denied: %s", errorString))
 		return
 	}
-	if req.FormValue("state") != csrf.Value {
+	if stateErr != nil || subtle.ConstantTimeCompare([]byte(req.FormValue("state")), []byte(state.State)) != 1 {
 		errMsg := "invalid csrf state"
 		errorHandler(res, req, errMsg)
 		return
 	}
 
 	// Exchange auth code for access/refresh token pair
-	err = p.provider.Exchange(req.FormValue("code"))
+	token, err := provider.Exchange(req.Context(), req.FormValue("code"), state)
 	if err != nil {
-		errMsg := fmt.Sprintf("failed to exchange authorization code with %s", p.provider.Data().Name)
+		errMsg := fmt.Sprintf("failed to exchange authorization code with %s", provider.Data().Name)
 		errorHandler(res, req, errMsg)
 		return
 	}
 
 	// Get userinfo from provider
-	user, err := p.provider.GetUser()
+	user, err := provider.GetUser(req.Context(), token)
 	if err != nil {
 		errMsg := "failed to get userdata from Oauth provider"
 		errorHandler(res, req, errMsg)
 		return
 	}
 
-	log.Debug().Str("id", user.GetID()).Str("user", user.GetUsername()).Msg("user logged in")
+	log.Debug().Str("id", user.GetID()).Str("user", user.GetUsername()).Str("provider", provider.Data().Name).Msg("user logged in")
 
 	// Set session data
 	s := session.Data{
-		ID:         user.GetID(),
-		Name:       user.GetName(),
-		Email:      user.GetEmail(),
-		Authorized: false,
+		ID:            user.GetID(),
+		Name:          user.GetName(),
+		Email:         user.GetEmail(),
+		EmailVerified: user.GetEmailVerified(),
+		Groups:        user.GetGroups(),
+		Provider:      provider.Data().Name,
+		Authorized:    false,
+	}
+	if u, ok := user.(providers.HostedDomainUser); ok {
+		s.HostedDomain = u.GetHostedDomain()
+	}
+	if !provider.AuthenticateSession(&s) {
+		log.Info().Str("id", user.GetID()).Str("user", user.GetUsername()).Msg("user not allowed to log in")
+		errorHandler(res, req, "Permission denied: you are not allowed to access this site")
+		return
 	}
-	_ = p.sessionManager.AttachSession(res, s)
-	http.Redirect(res, req, "/?", http.StatusFound)
+	if err := p.requestAccess(&s); err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to store access request")
+		errorHandler(res, req, "failed to request access")
+		return
+	}
+	if err := p.sessionManager.AttachSession(res, req, s); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach session")
+		errorHandler(res, req, "failed to create session")
+		return
+	}
+	if !s.Authorized {
+		http.Redirect(res, req, p.pendingPath, http.StatusFound)
+		return
+	}
+	http.Redirect(res, req, p.redirectURL(req, state.Redirect), http.StatusFound)
 }
 
 func disableCaching(res http.ResponseWriter) {
@@ -296,24 +494,60 @@ func (p Proxy) ErrorPage(res http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) LoginPage(res http.ResponseWriter, req *http.Request) {
-	p.sessionManager.RemoveSession(res)
+	p.sessionManager.RemoveSession(res, req)
 	disableCaching(res)
 
+	var csrfToken string
+	if p.localAuth != nil {
+		var err error
+		if csrfToken, err = p.sessionManager.AttachCSRFToken(res); err != nil {
+			log.Error().AnErr("err", err).Msg("failed to create csrf token")
+			errorHandler(res, req, "failed to create login form")
+			return
+		}
+	}
+
+	type providerLogin struct {
+		ID        string
+		Name      string
+		LoginPath string
+	}
+	var logins []providerLogin
+	for _, provider := range p.providers {
+		logins = append(logins, providerLogin{
+			ID:        strings.ToLower(provider.Data().Name),
+			Name:      provider.Data().GetDisplayName(),
+			LoginPath: provider.GetLoginPath(),
+		})
+	}
+
 	name := "login.tpl"
 	data := struct {
-		LoginPath         string
-		ProviderLoginPath string
-		StaticPath        string
+		LoginPath   string
+		Providers   []providerLogin
+		LocalAuth   bool
+		Passkeys    bool
+		CSRFToken   string
+		Error       string
+		Redirect    string
+		PasskeyPath string
+		StaticPath  string
 	}{
-		LoginPath:         p.loginPath,
-		ProviderLoginPath: p.provider.GetLoginPath(),
-		StaticPath:        p.staticPath,
+		LoginPath:   p.loginPath,
+		Providers:   logins,
+		LocalAuth:   p.localAuth != nil,
+		Passkeys:    p.passkeys != nil,
+		CSRFToken:   csrfToken,
+		Error:       loginErrors[req.URL.Query().Get("error")],
+		Redirect:    p.redirectURL(req, req.URL.Query().Get("p")),
+		PasskeyPath: p.passkeyPath,
+		StaticPath:  p.staticPath,
 	}
 	_ = p.getTemplate(name).ExecuteTemplate(res, name, data)
 }
 
 func (p *Proxy) ResetPage(res http.ResponseWriter, req *http.Request) {
-	p.sessionManager.RemoveSession(res)
+	p.sessionManager.RemoveSession(res, req)
 	disableCaching(res)
 
 	name := "reset.tpl"
@@ -326,7 +560,7 @@ func (p *Proxy) ResetPage(res http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) SignupPage(res http.ResponseWriter, req *http.Request) {
-	p.sessionManager.RemoveSession(res)
+	p.sessionManager.RemoveSession(res, req)
 	disableCaching(res)
 
 	name := "signup.tpl"
@@ -348,21 +582,46 @@ func (p *Proxy) StaticFolder(res http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) Logout(res http.ResponseWriter, req *http.Request) {
-	p.sessionManager.RemoveSession(res)
+	p.sessionManager.RemoveSession(res, req)
 	http.Redirect(res, req, "/", http.StatusFound)
 }
 
 func (p *Proxy) Proxy(res http.ResponseWriter, req *http.Request) {
-	if !p.Authenticate(req) {
-		p.sessionManager.RemoveSession(res)
-		http.Redirect(res, req, fmt.Sprintf("%s?p=%s", p.loginPath, req.URL.Path), http.StatusFound)
-	} else {
-		p.serveReverseProxy(p.getProxyURL(), true, res, req)
+	s, d := p.authorize(req)
+	switch d {
+	case decisionAllow:
+		if err := p.sessionManager.RefreshSession(res, req, s); err != nil {
+			log.Error().AnErr("err", err).Msg("failed to refresh session")
+		}
+		p.serveReverseProxy(p.getProxyURL(), true, s, res, req)
+	case decisionLogin:
+		p.sessionManager.RemoveSession(res, req)
+		http.Redirect(res, req, p.loginURL(req.URL.RequestURI()), http.StatusFound)
+	case decisionPending:
+		http.Redirect(res, req, p.pendingPath, http.StatusFound)
+	default:
+		errorHandler(res, req, "Permission denied: you are not allowed to access this page")
 	}
 }
 
+// providerForPath returns the provider owning the login or callback path, and whether it is the callback path
+func (p *Proxy) providerForPath(path string) (providers.Provider, bool) {
+	for _, provider := range p.providers {
+		switch path {
+		case provider.GetLoginPath():
+			return provider, false
+		case provider.GetCallbackPath():
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
 func (p *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	switch cleanPath := strings.TrimSuffix(req.URL.Path, "/"); {
+	cleanPath := strings.TrimSuffix(req.URL.Path, "/")
+	provider, callback := p.providerForPath(cleanPath)
+
+	switch {
 	case cleanPath == p.errorPath && req.Method == "GET":
 		p.ErrorPage(res, req)
 	case cleanPath == p.resetPath && req.Method == "GET":
@@ -375,14 +634,26 @@ func (p *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		p.Login(res, req)
 	case strings.HasPrefix(cleanPath, p.staticPath) && req.Method == "GET":
 		p.StaticFolder(res, req)
-	case cleanPath == p.provider.GetLoginPath():
-		p.Login(res, req)
+	case provider != nil && !callback:
+		p.ProviderLogin(provider, res, req)
 	case cleanPath == p.logoutPath:
 		p.Logout(res, req)
-	case p.IsWhitelistRequest(req):
-		p.serveReverseProxy(p.getProxyURL(), true, res, req)
-	case cleanPath == p.provider.GetCallbackPath():
-		p.OauthCallback(res, req)
+	case cleanPath == p.verifyPath:
+		p.Verify(res, req)
+	case cleanPath == p.totpPath && req.Method == "GET" && p.totp != nil:
+		p.TOTPPage(res, req)
+	case cleanPath == p.totpPath && req.Method == "POST" && p.totp != nil:
+		p.VerifyTOTP(res, req)
+	case (cleanPath == p.passkeyPath || strings.HasPrefix(cleanPath, p.passkeyPath+"/")) && p.passkeys != nil:
+		p.Passkey(res, req)
+	case cleanPath == p.jwksPath && req.Method == "GET":
+		p.JWKS(res, req)
+	case cleanPath == p.pendingPath && req.Method == "GET":
+		p.PendingPage(res, req)
+	case cleanPath == p.adminPath || strings.HasPrefix(cleanPath, p.adminPath+"/"):
+		p.Admin(res, req)
+	case provider != nil && callback:
+		p.OauthCallback(provider, res, req)
 	default:
 		p.Proxy(res, req)
 	}
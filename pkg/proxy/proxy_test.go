@@ -1,12 +1,22 @@
 package proxy
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
 	"github.com/gorilla/mux"
+	"github.com/habakke/auth-proxy/internal/access"
+	"github.com/habakke/auth-proxy/internal/assertion"
+	"github.com/habakke/auth-proxy/internal/auth"
 	"github.com/habakke/auth-proxy/internal/auth/providers"
 	"github.com/habakke/auth-proxy/internal/healthz"
 	"github.com/habakke/auth-proxy/internal/metrics"
+	"github.com/habakke/auth-proxy/internal/policy"
 	"github.com/habakke/auth-proxy/internal/session"
 	"github.com/habakke/auth-proxy/pkg/util"
 	"github.com/habakke/auth-proxy/pkg/util/logutils"
@@ -14,10 +24,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -31,6 +48,9 @@ func TestMain(m *testing.M) {
 	_ = os.Setenv("STATIC_DIR", fmt.Sprintf("%s/../../static", cwd))
 	_ = os.Setenv("ENV", "local")
 	_ = os.Setenv("LOGLEVEL", "trace")
+	_ = os.Setenv("GOOGLE_OAUTH_CALLBACK_URL", "http://localhost/auth/google/callback")
+	_ = os.Setenv("GOOGLE_OAUTH_CLIENT_ID", "client-id")
+	_ = os.Setenv("GOOGLE_OAUTH_CLIENT_SECRET", "client-secret")
 	logutils.ConfigureLogging()
 	metrics.ConfigurePrometheusMetrics()
 	code := m.Run()
@@ -58,7 +78,7 @@ func TestMakeUnauthenticatedProxyRequest(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -84,7 +104,7 @@ func TestMakeAuthenticatedProxyRequest(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -95,7 +115,7 @@ func TestMakeAuthenticatedProxyRequest(t *testing.T) {
 	require.NoError(t, err)
 
 	// Fake a logged-in session by attaching a session cookie to the request
-	payload, _ := json.Marshal(session.Data{ID: "test", Name: "Test"})
+	payload, _ := json.Marshal(session.Data{ID: "test", Name: "Test", EmailVerified: true})
 	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
 	require.NoError(t, err)
 	req.AddCookie(c)
@@ -116,7 +136,7 @@ func TestMetricsEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.Use(metrics.CreatePrometheusHTTPMetricsHandler)
 	pr.Handle("/metrics", promhttp.Handler())
@@ -124,7 +144,7 @@ func TestMetricsEndpoint(t *testing.T) {
 	proxyURL := testutils.StartProxy(pr)
 
 	// Fake a logged-in session by attaching a session cookie to the request
-	payload, _ := json.Marshal(session.Data{ID: "test", Name: "Test"})
+	payload, _ := json.Marshal(session.Data{ID: "test", Name: "Test", EmailVerified: true})
 	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
 	require.NoError(t, err)
 
@@ -173,7 +193,7 @@ func TestHealthzEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.Handle("/healthz", healthz.Handler())
 	pr.PathPrefix("/").Handler(proxy)
@@ -198,7 +218,7 @@ func TestStaticEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -222,7 +242,7 @@ func TestErrorEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -251,7 +271,7 @@ func TestLoginEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -276,7 +296,7 @@ func TestLogoutEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -300,7 +320,7 @@ func TestResetEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -325,7 +345,7 @@ func TestSignupEndpoint(t *testing.T) {
 	// Create proxy
 	provider := providers.New("Google", &providers.ProviderData{})
 	sm := session.NewManager(cookieSeed, cookieKey)
-	proxy := NewProxy(serverURL, provider, sm)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
 	pr := mux.NewRouter()
 	pr.PathPrefix("/").Handler(proxy)
 	proxyURL := testutils.StartProxy(pr)
@@ -340,3 +360,1007 @@ func TestSignupEndpoint(t *testing.T) {
 	testutils.CheckResponseCode(t, res, http.StatusOK)
 	testutils.CheckResponseBody(t, res, "Signup and become a ninja")
 }
+
+func TestMultipleProviders(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy with a restricted GitHub provider next to Google
+	google := providers.New("google", &providers.ProviderData{})
+	github := providers.NewGitHubProvider(&providers.ProviderData{}, &oauth2.Config{
+		ClientID: "client-id",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://github.example.com/login/oauth/authorize"},
+	})
+	github.Orgs = []string{"habakke"}
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{google, github}, sm)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+
+	// The login page has a button for each provider
+	client := testutils.CreateHTTPClient(false)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", proxyURL, proxy.loginPath), nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "Continue with Google")
+	require.Contains(t, string(body), "Continue with GitHub")
+	require.Contains(t, string(body), github.GetLoginPath())
+
+	// Each login path is dispatched to its own provider
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s%s", proxyURL, github.GetLoginPath()), nil)
+	require.NoError(t, err)
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.True(t, strings.HasPrefix(res.Header.Get("Location"), "https://github.example.com/"))
+
+	// Sessions are authenticated by the provider recorded in the session
+	for _, tt := range []struct {
+		data session.Data
+		code int
+	}{
+		{data: session.Data{ID: "test", Provider: "Google", EmailVerified: true}, code: http.StatusOK},
+		{data: session.Data{ID: "test", Provider: "GitHub", Groups: []string{"habakke"}}, code: http.StatusOK},
+		{data: session.Data{ID: "test", Provider: "GitHub", Groups: []string{"other"}}, code: http.StatusFound},
+		{data: session.Data{ID: "test", Provider: "Unknown"}, code: http.StatusFound},
+	} {
+		payload, _ := json.Marshal(tt.data)
+		c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+		require.NoError(t, err)
+		req, err = http.NewRequest("GET", fmt.Sprintf("%s/test1234", proxyURL), nil)
+		require.NoError(t, err)
+		req.AddCookie(c)
+		res, err = client.Do(req)
+		require.NoError(t, err)
+		testutils.CheckResponseCode(t, res, tt.code)
+	}
+}
+
+// newTestGoogleProvider returns a Google provider backed by a stub IdP, which logs in the user for any code
+func newTestGoogleProvider(user providers.GoogleUserInfo) *providers.GoogleProvider {
+	idp := http.NewServeMux()
+	idp.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write([]byte(`{"access_token":"access","token_type":"Bearer"}`))
+	})
+	idp.HandleFunc("/userinfo", func(res http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(res).Encode(user)
+	})
+	idpURL := testutils.StartTestServer(idp)
+
+	google := providers.NewGoogleProvider(&providers.ProviderData{}, &oauth2.Config{
+		ClientID: "client-id",
+		Endpoint: oauth2.Endpoint{AuthURL: idpURL + "/authorize", TokenURL: idpURL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	})
+	google.UserInfoURL = idpURL + "/userinfo?access_token="
+	return google
+}
+
+// providerLogin completes a login with the provider, and returns the response of the callback
+func providerLogin(t *testing.T, client *http.Client, proxyURL string, provider providers.Provider, redirect string) *http.Response {
+	res, err := client.Get(fmt.Sprintf("%s%s?p=%s", proxyURL, provider.GetLoginPath(), url.QueryEscape(redirect)))
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	authURL, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?code=code&state=%s", proxyURL, provider.GetCallbackPath(), authURL.Query().Get("state")), nil)
+	require.NoError(t, err)
+	for _, c := range res.Cookies() {
+		req.AddCookie(c)
+	}
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func TestLoginRedirect(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	google := newTestGoogleProvider(providers.GoogleUserInfo{ID: "test", Email: "test@example.com", Verified: true})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{google}, sm)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	// Unauthenticated requests are sent to the login page, which remembers the original URL
+	res, err := client.Get(fmt.Sprintf("%s/test1234?a=1&b=2", proxyURL))
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, "/auth/login?p=%2Ftest1234%3Fa%3D1%26b%3D2", res.Header.Get("Location"))
+
+	res, err = client.Get(proxyURL + res.Header.Get("Location"))
+	require.NoError(t, err)
+	testutils.CheckResponseBody(t, res, `name="p" value="/test1234?a=1&amp;b=2"`)
+
+	for _, tt := range []struct {
+		redirect string
+		expected string
+	}{
+		{redirect: "/test1234?a=1&b=2", expected: "/test1234?a=1&b=2"},
+		{redirect: "https://evil.com/test1234", expected: "/"},
+	} {
+		// The original URL is carried through the login state
+		res = providerLogin(t, client, proxyURL, google, tt.redirect)
+		testutils.CheckResponseCode(t, res, http.StatusFound)
+		require.Equal(t, tt.expected, res.Header.Get("Location"))
+	}
+}
+
+// publicPolicy returns the policy letting anonymous requests through to /public/
+func publicPolicy(t *testing.T) *policy.Policy {
+	rules := &policy.Policy{Rules: []*policy.Rule{{Path: "^/public/", Action: policy.AllowAnonymous}}}
+	require.NoError(t, rules.Compile())
+	return rules
+}
+
+func TestVerifyEndpoint(t *testing.T) {
+	provider := providers.New("Google", &providers.ProviderData{})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy("http://localhost", []providers.Provider{provider}, sm)
+	proxy.SetPolicy(publicPolicy(t))
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	payload, _ := json.Marshal(session.Data{ID: "test", Email: "test@example.com", Groups: []string{"a", "b"}, Provider: "Google", EmailVerified: true})
+	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+
+	verify := func(headers map[string]string, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest("GET", proxyURL+proxy.verifyPath, nil)
+		require.NoError(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	traefik := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.example.com", "X-Forwarded-Uri": "/test1234?a=1"}
+
+	// Valid sessions are answered with the identity of the user
+	res := verify(traefik, c)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	require.Equal(t, "test", res.Header.Get("X-Auth-Request-User"))
+	require.Equal(t, "test@example.com", res.Header.Get("X-Auth-Request-Email"))
+	require.Equal(t, "a,b", res.Header.Get("X-Auth-Request-Groups"))
+	require.Equal(t, "Google", res.Header.Get("X-Auth-Request-Provider"))
+
+	// Requests without a session are rejected, unless the policy allows anonymous requests to the original path
+	res = verify(traefik, nil)
+	testutils.CheckResponseCode(t, res, http.StatusUnauthorized)
+	res = verify(map[string]string{"X-Original-URL": "https://app.example.com/public/index.html"}, nil)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	require.Empty(t, res.Header.Get("X-Auth-Request-User"))
+
+	// Or redirected to the login page with the original URL
+	proxy.SetVerifyRedirect(true)
+	res = verify(traefik, nil)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, "/auth/login?p="+url.QueryEscape("https://app.example.com/test1234?a=1"), res.Header.Get("Location"))
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	// Create mock service echoing the identity headers
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Groups", "X-Forwarded-Provider", "X_Forwarded_User", "X-Forwarded_Groups"} {
+			_, _ = w.Write([]byte(fmt.Sprintf("%s=%s\n", h, strings.Join(req.Header.Values(h), ";"))))
+		}
+	})
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	provider := providers.New("Google", &providers.ProviderData{})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
+	proxy.SetPolicy(publicPolicy(t))
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	payload, _ := json.Marshal(session.Data{ID: "test", Email: "test@example.com", Groups: []string{"a", "b"}, Provider: "Google", EmailVerified: true})
+	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+
+	// The identity of the session replaces any spoofed identity
+	req, err := http.NewRequest("GET", proxyURL+"/test1234", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("X-Forwarded-Groups", "admins")
+	req.Header["x_forwarded_user"] = []string{"admin"}
+	req.Header.Set("X-Forwarded_Groups", "admins")
+	req.AddCookie(c)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "X-Forwarded-User=test\n")
+	require.Contains(t, string(body), "X-Forwarded-Email=test@example.com\n")
+	require.Contains(t, string(body), "X-Forwarded-Groups=a,b\n")
+	require.Contains(t, string(body), "X-Forwarded-Provider=Google\n")
+	require.Contains(t, string(body), "X_Forwarded_User=\n")
+	require.Contains(t, string(body), "X-Forwarded_Groups=\n")
+
+	// Spoofed identities are removed from anonymous requests
+	req, err = http.NewRequest("GET", proxyURL+"/public/index.html", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("X_Forwarded_User", "admin")
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "X-Forwarded-User=\n")
+	require.Contains(t, string(body), "X_Forwarded_User=\n")
+
+	// Disabled headers are not sent
+	headers := DefaultIdentityHeaders()
+	headers.Email = ""
+	proxy.SetIdentityHeaders(headers)
+	req, err = http.NewRequest("GET", proxyURL+"/test1234", nil)
+	require.NoError(t, err)
+	req.AddCookie(c)
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "X-Forwarded-User=test\n")
+	require.Contains(t, string(body), "X-Forwarded-Email=\n")
+}
+
+func TestIdentityAssertion(t *testing.T) {
+	// Create mock service echoing the assertion
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Header.Get(DefaultAssertionHeader)))
+	})
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := assertion.NewSigner(key)
+	require.NoError(t, err)
+	provider := providers.New("Google", &providers.ProviderData{})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
+	proxy.SetIdentityAssertion(signer, DefaultAssertionHeader)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	// The upstream fetches the keys from the JWKS endpoint
+	res, err := client.Get(proxyURL + proxy.jwksPath)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	keys := jose.JSONWebKeySet{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&keys))
+	require.Len(t, keys.Keys, 1)
+
+	payload, _ := json.Marshal(session.Data{ID: "test", Email: "test@example.com", Provider: "Google", EmailVerified: true})
+	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", proxyURL+"/test1234", nil)
+	require.NoError(t, err)
+	req.Header.Set(DefaultAssertionHeader, "spoofed")
+	req.AddCookie(c)
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	token, err := jwt.ParseSigned(string(body))
+	require.NoError(t, err)
+	claims := assertion.Claims{}
+	require.NoError(t, token.Claims(keys.Keys[0].Key, &claims))
+	require.Equal(t, "test", claims.Subject)
+	require.Equal(t, "test@example.com", claims.Email)
+}
+
+func TestPolicy(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	rules := &policy.Policy{Rules: []*policy.Rule{
+		{Path: "^/public/", Action: policy.AllowAnonymous},
+		{Path: "^/admin/", Action: policy.RequireGroup, Groups: []string{"admins"}},
+		{Path: "^/private/", Action: policy.Deny},
+		{Path: "^/api/", Methods: []string{"OPTIONS"}, Action: policy.AllowAnonymous},
+	}}
+	require.NoError(t, rules.Compile())
+	provider := providers.New("Google", &providers.ProviderData{})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
+	proxy.SetPolicy(rules)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	user, _ := json.Marshal(session.Data{ID: "user", Provider: "Google", EmailVerified: true})
+	admin, _ := json.Marshal(session.Data{ID: "admin", Groups: []string{"admins"}, Provider: "Google", EmailVerified: true})
+	for _, tt := range []struct {
+		method   string
+		path     string
+		session  []byte
+		code     int
+		location string
+	}{
+		{path: "/public/index.html", code: http.StatusOK},
+		{method: "OPTIONS", path: "/api/users", code: http.StatusOK},
+		{method: "OPTIONS", path: "/test1234", code: http.StatusFound, location: "/auth/login?p=%2Ftest1234"},
+		{method: "OPTIONS", path: "/private/", session: admin, code: http.StatusTemporaryRedirect, location: "/auth/error?"},
+		{path: "/test1234", code: http.StatusFound, location: "/auth/login?p=%2Ftest1234"},
+		{path: "/test1234", session: user, code: http.StatusOK},
+		{path: "/admin/users", code: http.StatusFound, location: "/auth/login?p=%2Fadmin%2Fusers"},
+		{path: "/admin/users", session: user, code: http.StatusTemporaryRedirect, location: "/auth/error?"},
+		{path: "/admin/users", session: admin, code: http.StatusOK},
+		{path: "/private/", session: admin, code: http.StatusTemporaryRedirect, location: "/auth/error?"},
+	} {
+		method := tt.method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, proxyURL+tt.path, nil)
+		require.NoError(t, err)
+		if tt.session != nil {
+			c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(tt.session))
+			require.NoError(t, err)
+			req.AddCookie(c)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		testutils.CheckResponseCode(t, res, tt.code)
+		require.True(t, strings.HasPrefix(res.Header.Get("Location"), tt.location), tt.path)
+	}
+
+	// The forward authentication endpoint applies the same policy
+	for _, tt := range []struct {
+		method  string
+		path    string
+		session []byte
+		code    int
+	}{
+		{path: "/public/index.html", code: http.StatusOK},
+		{method: "OPTIONS", path: "/api/users", code: http.StatusOK},
+		{method: "OPTIONS", path: "/test1234", code: http.StatusUnauthorized},
+		{method: "OPTIONS", path: "/private/", session: admin, code: http.StatusForbidden},
+		{path: "/admin/users", code: http.StatusUnauthorized},
+		{path: "/admin/users", session: user, code: http.StatusForbidden},
+		{path: "/admin/users", session: admin, code: http.StatusOK},
+		{path: "/private/", session: admin, code: http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("GET", proxyURL+proxy.verifyPath, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-Uri", tt.path)
+		if tt.method != "" {
+			req.Header.Set("X-Forwarded-Method", tt.method)
+		}
+		if tt.session != nil {
+			c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(tt.session))
+			require.NoError(t, err)
+			req.AddCookie(c)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		testutils.CheckResponseCode(t, res, tt.code)
+	}
+}
+
+func TestEmailAllowList(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	provider := providers.New("Google", &providers.ProviderData{AllowedDomains: []string{"example.com"}})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{provider}, sm)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	payload, _ := json.Marshal(session.Data{ID: "test", Email: "test@example.com", EmailVerified: true, Provider: "Google"})
+	c, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+	get := func() *http.Response {
+		req, err := http.NewRequest("GET", proxyURL+"/test1234", nil)
+		require.NoError(t, err)
+		req.AddCookie(c)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	testutils.CheckResponseCode(t, get(), http.StatusOK)
+
+	// Changes to the allow lists apply to existing sessions
+	provider.Data().AllowedDomains = []string{"other.com"}
+	testutils.CheckResponseCode(t, get(), http.StatusFound)
+}
+
+func TestAccessRequests(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	store, err := access.NewBoltStore(filepath.Join(t.TempDir(), "access.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	google := newTestGoogleProvider(providers.GoogleUserInfo{ID: "test", Email: "test@example.com", Verified: true})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{google}, sm)
+	proxy.SetAccessStore(store)
+	proxy.SetAdmins([]string{"admin@example.com"}, nil)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest("GET", proxyURL+path, nil)
+		require.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	post := func(contentType string, body string, headers map[string]string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest("POST", proxyURL+proxy.adminPath+"/requests", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// New users are sent to the pending page
+	res := providerLogin(t, client, proxyURL, google, "/test1234")
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, proxy.pendingPath, res.Header.Get("Location"))
+	user := res.Cookies()[len(res.Cookies())-1]
+	require.Equal(t, session.SessionCookieName, user.Name)
+
+	res = get("/test1234", user)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, proxy.pendingPath, res.Header.Get("Location"))
+	testutils.CheckResponseBody(t, get(proxy.pendingPath, user), "Access pending")
+
+	// Only admins can see and decide access requests
+	testutils.CheckResponseCode(t, get(proxy.adminPath, user), http.StatusForbidden)
+	payload, _ := json.Marshal(session.Data{ID: "admin", Email: "admin@example.com", EmailVerified: true, Provider: "Google"})
+	admin, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+	testutils.CheckResponseBody(t, get(proxy.adminPath, admin), "test@example.com")
+
+	// Admin groups qualified with a provider only match groups of that provider
+	proxy.SetAdmins([]string{"admin@example.com"}, []string{"ldap:admins"})
+	payload, _ = json.Marshal(session.Data{ID: "other", Email: "other@example.com", EmailVerified: true, Groups: []string{"admins"}, Provider: "Google"})
+	other, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, get(proxy.adminPath, other), http.StatusForbidden)
+	proxy.SetAdmins([]string{"admin@example.com"}, []string{"google:admins"})
+	testutils.CheckResponseCode(t, get(proxy.adminPath, other), http.StatusOK)
+	proxy.SetAdmins([]string{"admin@example.com"}, nil)
+
+	res = get(proxy.adminPath+"/requests", admin)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	var requests []access.Request
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&requests))
+	require.Len(t, requests, 1)
+	require.Equal(t, "google:test", requests[0].ID)
+	require.Equal(t, access.Pending, requests[0].Status)
+
+	// Approved users reach the upstream. Forms must carry the CSRF token of the admin page.
+	res = get(proxy.adminPath, admin)
+	body, _ := io.ReadAll(res.Body)
+	match := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(body)
+	require.NotNil(t, match)
+	var csrf *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == session.LoginCSRFCookieName {
+			csrf = c
+		}
+	}
+	require.NotNil(t, csrf)
+	form := "id=google%3Atest&status=approved&csrf_token=" + string(match[1])
+	res = post("application/x-www-form-urlencoded", form, map[string]string{"Origin": "https://evil.com"}, admin, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+	res = post("application/x-www-form-urlencoded", form, map[string]string{"Referer": "https://evil.com/"}, admin, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+	res = post("application/x-www-form-urlencoded", "id=google%3Atest&status=approved", nil, admin)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+	res = post("application/x-www-form-urlencoded", form, nil, admin, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	res = get("/test1234", user)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	testutils.CheckResponseBody(t, res, "path=/test1234")
+
+	// Denied users are stopped on the next request
+	res = post("application/json", `{"id":"google:test","status":"denied"}`, nil, admin)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	res = get("/test1234", user)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	testutils.CheckResponseBody(t, get(proxy.pendingPath, user), "Access denied")
+
+	res = post("application/json", `{"id":"google:other","status":"approved"}`, nil, admin)
+	testutils.CheckResponseCode(t, res, http.StatusNotFound)
+}
+
+func TestSessionStore(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	store := session.NewMemoryStore()
+	google := newTestGoogleProvider(providers.GoogleUserInfo{ID: "test", Email: "test@example.com", Verified: true})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	sm.SetStore(store)
+	proxy := NewProxy(serverURL, []providers.Provider{google}, sm)
+	proxy.SetAdmins([]string{"admin@example.com"}, nil)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	do := func(method string, path string, body string, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest(method, proxyURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.AddCookie(cookie)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	login := func() *http.Cookie {
+		res := providerLogin(t, client, proxyURL, google, "/test1234")
+		testutils.CheckResponseCode(t, res, http.StatusFound)
+		c := res.Cookies()[len(res.Cookies())-1]
+		require.Equal(t, session.SessionCookieName, c.Name)
+		return c
+	}
+
+	// Logging out deletes the session, so the cookie can not be replayed
+	user := login()
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", user), http.StatusOK)
+	testutils.CheckResponseCode(t, do("GET", proxy.logoutPath, "", user), http.StatusFound)
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", user), http.StatusFound)
+
+	// Admins can revoke all sessions of a user
+	first, second := login(), login()
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", first), http.StatusOK)
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", second), http.StatusOK)
+
+	require.NoError(t, store.Save(context.Background(), "admin", session.Data{ID: "admin", Email: "admin@example.com", EmailVerified: true, Provider: "Google"}, time.Hour))
+	admin, err := sm.MakeSessionCookie(cookieSeed, cookieKey, "admin")
+	require.NoError(t, err)
+	revoke := `{"provider":"google","user_id":"test"}`
+	testutils.CheckResponseCode(t, do("POST", proxy.adminPath+"/sessions", revoke, first), http.StatusForbidden)
+	testutils.CheckResponseCode(t, do("POST", proxy.adminPath+"/sessions", `{}`, admin), http.StatusBadRequest)
+	req, err := http.NewRequest("POST", proxyURL+proxy.adminPath+"/sessions", strings.NewReader(revoke))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.AddCookie(admin)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+	testutils.CheckResponseCode(t, do("POST", proxy.adminPath+"/sessions", revoke, admin), http.StatusNoContent)
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", first), http.StatusFound)
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", second), http.StatusFound)
+	testutils.CheckResponseCode(t, do("GET", "/test1234", "", admin), http.StatusOK)
+}
+
+func TestLocalLogin(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+	localAuth := auth.NewAuthLocal()
+	localAuth.AddUser(&auth.LocalUser{Username: "test@example.com", PasswordHash: hash})
+	proxy := NewProxy(serverURL, nil, session.NewManager(cookieSeed, cookieKey))
+	proxy.SetLocalAuth(localAuth)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	// loginPage returns the CSRF token and cookie of the login form
+	loginPage := func() (string, *http.Cookie) {
+		res, err := client.Get(proxyURL + proxy.loginPath)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		match := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(body)
+		require.NotNil(t, match)
+		for _, c := range res.Cookies() {
+			if c.Name == session.LoginCSRFCookieName {
+				return string(match[1]), c
+			}
+		}
+		require.Fail(t, "csrf cookie not set")
+		return "", nil
+	}
+	login := func(form url.Values, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest("POST", proxyURL+proxy.loginPath, strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// Logins without a valid CSRF token are rejected
+	token, csrf := loginPage()
+	res := login(url.Values{"username": {"test@example.com"}, "password": {"secret"}, "p": {"/test1234"}}, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, proxy.loginPath+"?p=%2Ftest1234&error=expired", res.Header.Get("Location"))
+	res = login(url.Values{"username": {"test@example.com"}, "password": {"secret"}, "csrf_token": {token}}, nil)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, proxy.loginPath+"?error=expired", res.Header.Get("Location"))
+
+	// Invalid credentials are shown on the login page
+	res = login(url.Values{"username": {"test@example.com"}, "password": {"wrong"}, "csrf_token": {token}}, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, proxy.loginPath+"?error=invalid", res.Header.Get("Location"))
+	res, err = client.Get(proxyURL + res.Header.Get("Location"))
+	require.NoError(t, err)
+	testutils.CheckResponseBody(t, res, "Invalid email address or password")
+
+	// Valid logins are sent on to the redirect with a session
+	res = login(url.Values{"username": {"test@example.com"}, "password": {"secret"}, "csrf_token": {token}, "p": {"/test1234"}}, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, "/test1234", res.Header.Get("Location"))
+	var user *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == session.SessionCookieName {
+			user = c
+		}
+	}
+	require.NotNil(t, user)
+	req, _ := http.NewRequest("GET", proxyURL+"/test1234", nil)
+	req.AddCookie(user)
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+
+	// Sessions end when the user is removed
+	localAuth.RemoveUser("test@example.com")
+	req, _ = http.NewRequest("GET", proxyURL+"/test1234", nil)
+	req.AddCookie(user)
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, proxy.loginPath+"?p=%2Ftest1234", res.Header.Get("Location"))
+}
+
+func TestTOTPLogin(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+	localAuth := auth.NewAuthLocal()
+	localAuth.AddUser(&auth.LocalUser{Username: "test@example.com", PasswordHash: hash})
+	totp := auth.NewTOTP(auth.NewMemoryTOTPStore(), "auth-proxy")
+	proxy := NewProxy(serverURL, nil, session.NewManager(cookieSeed, cookieKey))
+	proxy.SetLocalAuth(localAuth)
+	proxy.SetTOTP(totp)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	cookieOf := func(res *http.Response, name string) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == name && c.MaxAge >= 0 {
+				return c
+			}
+		}
+		return nil
+	}
+	// form returns the body, CSRF token and CSRF cookie of a page with a form
+	form := func(path string, cookie *http.Cookie) (string, string, *http.Cookie) {
+		req, _ := http.NewRequest("GET", proxyURL+path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		testutils.CheckResponseCode(t, res, http.StatusOK)
+		body, _ := io.ReadAll(res.Body)
+		match := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(body)
+		require.NotNil(t, match)
+		csrf := cookieOf(res, session.LoginCSRFCookieName)
+		require.NotNil(t, csrf)
+		return string(body), string(match[1]), csrf
+	}
+	post := func(path string, values url.Values, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest("POST", proxyURL+path, strings.NewReader(values.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	get := func(path string, cookie *http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", proxyURL+path, nil)
+		req.AddCookie(cookie)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	// login enters the password, and returns the session waiting for the second factor
+	login := func() *http.Cookie {
+		_, token, csrf := form(proxy.loginPath, nil)
+		res := post(proxy.loginPath, url.Values{"username": {"test@example.com"}, "password": {"secret"}, "csrf_token": {token}, "p": {"/test1234"}}, csrf)
+		testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+		require.Equal(t, proxy.totpPath+"?p=%2Ftest1234", res.Header.Get("Location"))
+		pending := cookieOf(res, session.SessionCookieName)
+		require.NotNil(t, pending)
+
+		// The session is not authenticated before the second factor is verified
+		res = get("/test1234", pending)
+		testutils.CheckResponseCode(t, res, http.StatusFound)
+		require.Equal(t, proxy.loginPath+"?p=%2Ftest1234", res.Header.Get("Location"))
+		return pending
+	}
+
+	// The second factor page requires a pending session
+	res, err := client.Get(proxyURL + proxy.totpPath)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	require.Equal(t, proxy.loginPath, res.Header.Get("Location"))
+
+	// Users enrol on their first login
+	pending := login()
+	body, token, csrf := form(proxy.totpPath+"?p=%2Ftest1234", pending)
+	require.Contains(t, body, "otpauth://totp/auth-proxy:test@example.com?")
+	require.Contains(t, body, "data:image/png;base64,")
+	e, err := totp.Enrolment(auth.TOTPUserKey(auth.LocalProviderName, "test@example.com"))
+	require.NoError(t, err)
+	require.False(t, e.Confirmed)
+	require.Contains(t, body, e.Secret)
+
+	res = post(proxy.totpPath, url.Values{"code": {"000000"}, "csrf_token": {token}, "p": {"/test1234"}}, pending, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, proxy.totpPath+"?error=code&p=%2Ftest1234", res.Header.Get("Location"))
+
+	code, err := auth.TOTPCode(e.Secret, time.Now())
+	require.NoError(t, err)
+	res = post(proxy.totpPath, url.Values{"code": {code}, "csrf_token": {token}, "p": {"/test1234"}}, pending, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	body2, _ := io.ReadAll(res.Body)
+	recoveryCodes := regexp.MustCompile(`<code>([a-z2-7]{5}-[a-z2-7]{5})</code>`).FindAllSubmatch(body2, -1)
+	require.Len(t, recoveryCodes, auth.RecoveryCodeCount)
+	user := cookieOf(res, session.SessionCookieName)
+	require.NotNil(t, user)
+	testutils.CheckResponseCode(t, get("/test1234", user), http.StatusOK)
+
+	// Enrolled users enter a code, or a recovery code, after the password
+	pending = login()
+	body, token, csrf = form(proxy.totpPath, pending)
+	require.NotContains(t, body, "otpauth://")
+	res = post(proxy.totpPath, url.Values{"code": {string(recoveryCodes[0][1])}, "csrf_token": {token}, "p": {"/test1234"}}, pending, csrf)
+	testutils.CheckResponseCode(t, res, http.StatusSeeOther)
+	require.Equal(t, "/test1234", res.Header.Get("Location"))
+	user = cookieOf(res, session.SessionCookieName)
+	require.NotNil(t, user)
+	testutils.CheckResponseCode(t, get("/test1234", user), http.StatusOK)
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	// Create mock service
+	sr := mux.NewRouter()
+	sr.PathPrefix("/").HandlerFunc(createDefaultHandlerFunc())
+	serverURL := testutils.StartTestServer(sr)
+
+	// Create proxy
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+	localAuth := auth.NewAuthLocal()
+	localAuth.AddUser(&auth.LocalUser{Username: "test@example.com", PasswordHash: hash})
+	google := providers.New("Google", &providers.ProviderData{})
+	sm := session.NewManager(cookieSeed, cookieKey)
+	proxy := NewProxy(serverURL, []providers.Provider{google}, sm)
+	proxy.SetLocalAuth(localAuth)
+	pr := mux.NewRouter()
+	pr.PathPrefix("/").Handler(proxy)
+	proxyURL := testutils.StartProxy(pr)
+	client := testutils.CreateHTTPClient(false)
+
+	passkeys, err := auth.NewPasskeys(testutils.ProxyServerHost, "auth-proxy", []string{proxyURL}, auth.NewMemoryPasskeyStore())
+	require.NoError(t, err)
+	proxy.SetPasskeys(passkeys)
+	authenticator := testutils.NewAuthenticator(proxyURL)
+
+	cookieOf := func(res *http.Response, name string) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == name && c.MaxAge >= 0 {
+				return c
+			}
+		}
+		return nil
+	}
+	post := func(path string, body []byte, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest("POST", proxyURL+proxy.passkeyPath+path, strings.NewReader(string(body)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", proxyURL)
+		for _, c := range cookies {
+			if c != nil {
+				req.AddCookie(c)
+			}
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	get := func(path string, cookie *http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", proxyURL+path, nil)
+		req.AddCookie(cookie)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	// ceremony begins a ceremony, answers it with the authenticator, and returns the response of the proxy
+	ceremony := func(name string, query string, answer func([]byte) ([]byte, error), cookie *http.Cookie) *http.Response {
+		res := post("/"+name+"/begin", nil, cookie)
+		testutils.CheckResponseCode(t, res, http.StatusOK)
+		state := cookieOf(res, session.PasskeyCookieName)
+		require.NotNil(t, state)
+		options, _ := io.ReadAll(res.Body)
+		credential, err := answer(options)
+		require.NoError(t, err)
+		return post("/"+name+"/finish"+query, credential, cookie, state)
+	}
+	redirectOf := func(res *http.Response) string {
+		result := struct {
+			Redirect string `json:"redirect"`
+		}{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return result.Redirect
+	}
+
+	// The login page offers passkeys
+	res, err := client.Get(proxyURL + proxy.loginPath)
+	require.NoError(t, err)
+	testutils.CheckResponseBody(t, res, "Sign in with a passkey")
+
+	// Passkeys are registered by signed in users
+	res, err = client.Get(proxyURL + proxy.passkeyPath)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusFound)
+	testutils.CheckResponseCode(t, post("/register/begin", nil), http.StatusUnauthorized)
+
+	res, err = client.Get(proxyURL + proxy.loginPath)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	match := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(body)
+	require.NotNil(t, match)
+	req, _ := http.NewRequest("POST", proxyURL+proxy.loginPath, strings.NewReader(url.Values{"username": {"test@example.com"}, "password": {"secret"}, "csrf_token": {string(match[1])}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookieOf(res, session.LoginCSRFCookieName))
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	user := cookieOf(res, session.SessionCookieName)
+	require.NotNil(t, user)
+
+	testutils.CheckResponseBody(t, get(proxy.passkeyPath, user), "Add a passkey")
+	res = ceremony("register", "", authenticator.Create, user)
+	testutils.CheckResponseCode(t, res, http.StatusNoContent)
+	testutils.CheckResponseBody(t, get(proxy.passkeyPath, user), "You have 1 passkey.")
+
+	// The API only accepts JSON from the proxy itself
+	req, _ = http.NewRequest("POST", proxyURL+proxy.passkeyPath+"/login/begin", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "text/plain")
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+	req, _ = http.NewRequest("POST", proxyURL+proxy.passkeyPath+"/login/begin", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://example.com")
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.CheckResponseCode(t, res, http.StatusForbidden)
+
+	// Users sign in with the passkey instead of the password
+	clone := authenticator.Clone()
+	res = ceremony("login", "?p=%2Ftest1234", authenticator.Get, nil)
+	testutils.CheckResponseCode(t, res, http.StatusOK)
+	require.Equal(t, "/test1234", redirectOf(res))
+	user = cookieOf(res, session.SessionCookieName)
+	require.NotNil(t, user)
+	testutils.CheckResponseCode(t, get("/test1234", user), http.StatusOK)
+
+	// Cloned passkeys are rejected, and the login page shows the error
+	res = ceremony("login", "?p=%2Ftest1234", clone.Get, nil)
+	testutils.CheckResponseCode(t, res, http.StatusUnauthorized)
+	require.Equal(t, proxy.loginPath+"?p=%2Ftest1234&error=passkey", redirectOf(res))
+	require.Nil(t, cookieOf(res, session.SessionCookieName))
+
+	// Assertions without the state of the ceremony are rejected
+	res = post("/login/begin", nil)
+	options, _ := io.ReadAll(res.Body)
+	assertion, err := authenticator.Get(options)
+	require.NoError(t, err)
+	res = post("/login/finish", assertion)
+	testutils.CheckResponseCode(t, res, http.StatusUnauthorized)
+	require.Equal(t, proxy.loginPath+"?error=expired", redirectOf(res))
+
+	// Passkeys of users removed from the backend are rejected
+	localAuth.RemoveUser("test@example.com")
+	res = ceremony("login", "", authenticator.Get, nil)
+	testutils.CheckResponseCode(t, res, http.StatusUnauthorized)
+	require.Equal(t, proxy.loginPath+"?error=passkey", redirectOf(res))
+	require.Nil(t, cookieOf(res, session.SessionCookieName))
+
+	// Users of providers can not add passkeys, as their profile can only be checked by logging in with the provider
+	payload, _ := json.Marshal(session.Data{ID: "1234", Email: "oauth@example.com", EmailVerified: true, Groups: []string{"admins"}, Provider: "Google"})
+	oauthUser, err := sm.MakeSessionCookie(cookieSeed, cookieKey, string(payload))
+	require.NoError(t, err)
+	testutils.CheckResponseBody(t, get(proxy.passkeyPath, oauthUser), "only available to users signing in with a username and password")
+	testutils.CheckResponseCode(t, post("/register/begin", nil, oauthUser), http.StatusForbidden)
+
+	// and passkeys stored for them are rejected
+	oauth := testutils.NewAuthenticator(proxyURL)
+	creation, state, err := passkeys.BeginRegistration(&session.Data{ID: "1234", Provider: "Google"})
+	require.NoError(t, err)
+	o, _ := json.Marshal(creation)
+	credential, err := oauth.Create(o)
+	require.NoError(t, err)
+	_, err = passkeys.FinishRegistration(&session.Data{ID: "1234", Provider: "Google"}, *state, strings.NewReader(string(credential)))
+	require.NoError(t, err)
+	res = ceremony("login", "", oauth.Get, nil)
+	testutils.CheckResponseCode(t, res, http.StatusUnauthorized)
+	require.Nil(t, cookieOf(res, session.SessionCookieName))
+}
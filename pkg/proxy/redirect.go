@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultRedirect = "/"
+
+// SetAllowedRedirectHosts sets the hosts, other than the host of the proxy itself, users may be sent to after
+// login. A host starting with a dot, ex. `.example.com`, allows all subdomains of that domain.
+func (p *Proxy) SetAllowedRedirectHosts(hosts []string) {
+	p.allowedRedirectHosts = hosts
+}
+
+// isAllowedRedirectHost returns true if the host is allow-listed for redirects after login
+func (p *Proxy) isAllowedRedirectHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range p.allowedRedirectHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectURL validates the URL a user asked to be sent to after login, and returns the default redirect
+// if it points to a host which is neither the proxy itself nor allow-listed
+func (p *Proxy) redirectURL(req *http.Request, target string) string {
+	if target == "" {
+		return defaultRedirect
+	}
+	// Browsers treat backslashes as slashes, so /\example.com is protocol relative
+	if strings.ContainsAny(target, "\\\r\n\t") {
+		return defaultRedirect
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return defaultRedirect
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// a path starting with more than one slash, ex. ///example.com, is protocol relative to browsers
+		if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || strings.HasPrefix(u.EscapedPath(), "//") {
+			return defaultRedirect
+		}
+		return u.String()
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return defaultRedirect
+	}
+	if !strings.EqualFold(u.Host, req.Host) && !p.isAllowedRedirectHost(u.Hostname()) {
+		return defaultRedirect
+	}
+	return u.String()
+}
+
+// loginURL returns the login page URL which sends the user back to the redirect after login
+func (p *Proxy) loginURL(redirect string) string {
+	if redirect == "" || redirect == defaultRedirect {
+		return p.loginPath
+	}
+	return p.loginPath + "?p=" + url.QueryEscape(redirect)
+}
+
+const (
+	loginErrorInvalid = "invalid"
+	loginErrorExpired = "expired"
+	loginErrorCode    = "code"
+	loginErrorLocked  = "locked"
+	loginErrorPasskey = "passkey"
+)
+
+// loginErrors are the messages shown on the login page for the error codes of failed logins. Only codes are passed
+// in the URL, so the page can not be made to show arbitrary text.
+var loginErrors = map[string]string{
+	loginErrorInvalid: "Invalid email address or password.",
+	loginErrorExpired: "The login form has expired, please try again.",
+	loginErrorCode:    "Invalid verification code.",
+	loginErrorLocked:  "Too many invalid verification codes, please try again in a few minutes.",
+	loginErrorPasskey: "The passkey was not accepted, please try again or sign in another way.",
+}
+
+// loginErrorURL returns the URL of the login page showing the error
+func (p *Proxy) loginErrorURL(redirect string, code string) string {
+	u := p.loginURL(redirect)
+	if strings.Contains(u, "?") {
+		return u + "&error=" + code
+	}
+	return u + "?error=" + code
+}
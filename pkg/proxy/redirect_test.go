@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectURL(t *testing.T) {
+	p := NewProxy("http://localhost", nil, nil)
+	p.SetAllowedRedirectHosts([]string{"app.example.com", ".example.org"})
+	req := httptest.NewRequest("GET", "https://proxy.example.com/auth/login", nil)
+
+	for _, tt := range []struct {
+		target   string
+		expected string
+	}{
+		{target: "", expected: "/"},
+		{target: "/test1234?a=1&b=2", expected: "/test1234?a=1&b=2"},
+		{target: "https://proxy.example.com/test1234?a=1", expected: "https://proxy.example.com/test1234?a=1"},
+		{target: "https://app.example.com/", expected: "https://app.example.com/"},
+		{target: "https://sub.example.org/", expected: "https://sub.example.org/"},
+		{target: "https://evil.com/", expected: "/"},
+		{target: "https://evil.com?.example.org", expected: "/"},
+		{target: "https://example.org.evil.com/", expected: "/"},
+		{target: "//evil.com/", expected: "/"},
+		{target: "/\\evil.com/", expected: "/"},
+		{target: "///evil.com", expected: "/"},
+		{target: "/\\/evil.com", expected: "/"},
+		{target: "/%2F/evil.com", expected: "/"},
+		{target: "http:evil.com", expected: "/"},
+		{target: "javascript:alert(1)", expected: "/"},
+		{target: "test1234", expected: "/"},
+	} {
+		require.Equal(t, tt.expected, p.redirectURL(req, tt.target), tt.target)
+	}
+}
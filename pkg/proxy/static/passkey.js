@@ -0,0 +1,126 @@
+// Runs the WebAuthn ceremonies of the passkey buttons. The options and responses are exchanged with the proxy as
+// JSON, with binary fields encoded as base64url.
+(function () {
+    function toBuffer(value) {
+        var s = atob(value.replace(/-/g, "+").replace(/_/g, "/"));
+        var bytes = new Uint8Array(s.length);
+        for (var i = 0; i < s.length; i++) {
+            bytes[i] = s.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    function toBase64URL(buffer) {
+        var s = "";
+        var bytes = new Uint8Array(buffer);
+        for (var i = 0; i < bytes.length; i++) {
+            s += String.fromCharCode(bytes[i]);
+        }
+        return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function post(url, body) {
+        return fetch(url, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify(body || {})
+        });
+    }
+
+    function options(res) {
+        if (!res.ok) {
+            throw new Error(res.statusText);
+        }
+        return res.json();
+    }
+
+    function credentialJSON(credential) {
+        var r = credential.response;
+        var response = {clientDataJSON: toBase64URL(r.clientDataJSON)};
+        if (r.attestationObject) {
+            response.attestationObject = toBase64URL(r.attestationObject);
+        }
+        if (r.authenticatorData) {
+            response.authenticatorData = toBase64URL(r.authenticatorData);
+            response.signature = toBase64URL(r.signature);
+            response.userHandle = r.userHandle ? toBase64URL(r.userHandle) : undefined;
+        }
+        return {id: credential.id, rawId: toBase64URL(credential.rawId), type: credential.type, response: response};
+    }
+
+    function showError(message) {
+        var e = document.querySelector("[data-passkey-error]");
+        if (e) {
+            e.textContent = message;
+            e.hidden = false;
+        }
+    }
+
+    function login(button) {
+        var path = button.getAttribute("data-passkey-login");
+        var redirect = button.getAttribute("data-redirect") || "/";
+        post(path + "/login/begin").then(options).then(function (o) {
+            o.publicKey.challenge = toBuffer(o.publicKey.challenge);
+            (o.publicKey.allowCredentials || []).forEach(function (c) {
+                c.id = toBuffer(c.id);
+            });
+            return navigator.credentials.get(o);
+        }).then(function (credential) {
+            return post(path + "/login/finish?p=" + encodeURIComponent(redirect), credentialJSON(credential));
+        }).then(function (res) {
+            return res.json();
+        }).then(function (result) {
+            window.location.assign(result.redirect);
+        }).catch(function () {
+            showError("Signing in with a passkey failed, please try again.");
+        });
+    }
+
+    function register(button) {
+        var path = button.getAttribute("data-passkey-register");
+        post(path + "/register/begin").then(options).then(function (o) {
+            o.publicKey.challenge = toBuffer(o.publicKey.challenge);
+            o.publicKey.user.id = toBuffer(o.publicKey.user.id);
+            (o.publicKey.excludeCredentials || []).forEach(function (c) {
+                c.id = toBuffer(c.id);
+            });
+            return navigator.credentials.create(o);
+        }).then(function (credential) {
+            return post(path + "/register/finish", credentialJSON(credential));
+        }).then(function (res) {
+            if (!res.ok) {
+                throw new Error(res.statusText);
+            }
+            window.location.reload();
+        }).catch(function () {
+            showError("Adding the passkey failed, please try again.");
+        });
+    }
+
+    function remove(button) {
+        var path = button.getAttribute("data-passkey-remove");
+        post(path + "/remove").then(function (res) {
+            if (!res.ok) {
+                throw new Error(res.statusText);
+            }
+            window.location.reload();
+        }).catch(function () {
+            showError("Removing the passkeys failed, please try again.");
+        });
+    }
+
+    var actions = {"data-passkey-login": login, "data-passkey-register": register, "data-passkey-remove": remove};
+    Object.keys(actions).forEach(function (attribute) {
+        document.querySelectorAll("[" + attribute + "]").forEach(function (button) {
+            if (!window.PublicKeyCredential) {
+                button.hidden = true;
+                return;
+            }
+            button.addEventListener("click", function (event) {
+                event.preventDefault();
+                actions[attribute](button);
+            });
+        });
+    });
+})();
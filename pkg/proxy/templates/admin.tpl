@@ -0,0 +1,92 @@
+<!DOCTYPE html>
+<html lang="en" class="no-min-dimensions">
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+
+    <title>Access requests</title>
+
+    <link rel="icon" type="image/x-icon" href="{{.StaticPath}}/favicon.png">
+
+    <link rel="apple-touch-icon" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="apple-touch-icon-precomposed" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="mask-icon" href="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF">
+
+    <meta charset="utf-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="apple-mobile-web-app-capable" content="yes">
+    <meta name="apple-mobile-web-app-status-bar-style" content="black">
+    <meta name="apple-mobile-web-app-title" content="Access requests">
+
+    <link rel="preload" href="{{.StaticPath}}/fa-regular-400.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/fa-solid-900.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-Regular.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-SemiBold.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+
+    <link rel="stylesheet" media="screen" href="{{.StaticPath}}/application.css" />
+</head>
+<body class="no-min-dimensions">
+
+<section class="onboarding">
+    <main class="onboarding__main">
+        <div class="onboarding__wrapper">
+
+            <header class="onboarding__header">
+                <h1 class="onboarding__title">Access requests</h1>
+            </header>
+
+            <table class="onboarding__form">
+                <thead>
+                <tr>
+                    <th>User</th>
+                    <th>Provider</th>
+                    <th>Requested</th>
+                    <th>Status</th>
+                    <th></th>
+                </tr>
+                </thead>
+                <tbody>
+                {{$requestsPath := .RequestsPath}}
+                {{$csrfToken := .CSRFToken}}
+                {{range .Requests}}
+                <tr>
+                    <td>{{if .Name}}{{.Name}} {{end}}{{.Email}}</td>
+                    <td>{{.Provider}}</td>
+                    <td>{{.RequestedAt.Format "2006-01-02 15:04"}}</td>
+                    <td>{{.Status}}{{if .DecidedBy}} by {{.DecidedBy}}{{end}}</td>
+                    <td>
+                        {{if ne .Status "approved"}}
+                        <form class="button_to" method="post" action="{{$requestsPath}}">
+                            <input type="hidden" name="id" value="{{.ID}}" />
+                            <input type="hidden" name="csrf_token" value="{{$csrfToken}}" />
+                            <input type="hidden" name="status" value="approved" />
+                            <input class="button onboarding__button" type="submit" value="Approve" />
+                        </form>
+                        {{end}}
+                        {{if ne .Status "denied"}}
+                        <form class="button_to" method="post" action="{{$requestsPath}}">
+                            <input type="hidden" name="id" value="{{.ID}}" />
+                            <input type="hidden" name="csrf_token" value="{{$csrfToken}}" />
+                            <input type="hidden" name="status" value="denied" />
+                            <input class="button onboarding__button onboarding__button--secondary" type="submit" value="Deny" />
+                        </form>
+                        {{end}}
+                    </td>
+                </tr>
+                {{else}}
+                <tr>
+                    <td colspan="5">There are no access requests</td>
+                </tr>
+                {{end}}
+                </tbody>
+            </table>
+
+            <p class="onboarding__footer">
+                <a href="{{.LogoutPath}}">Sign out</a>
+            </p>
+        </div>
+    </main>
+</section>
+
+</body>
+</html>
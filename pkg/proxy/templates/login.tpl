@@ -39,15 +39,34 @@
                 <h1 class="onboarding__title">Sign in</h1>
             </header>
 
-            <form class="button_to" method="get" action="{{.ProviderLoginPath}}">
-                <input class="button onboarding__button onboarding__button--full-width onboarding__button--google" type="submit" value="Continue with Google" />
+            {{range .Providers}}
+            <form class="button_to" method="get" action="{{.LoginPath}}">
+                <input type="hidden" name="p" value="{{$.Redirect}}" />
+                <input class="button onboarding__button onboarding__button--full-width {{if eq .ID "google"}}onboarding__button--google{{else}}onboarding__button--secondary{{end}}" type="submit" value="Continue with {{.Name}}" />
             </form>
+            {{end}}
 
+            {{if .Passkeys}}
+            <form class="button_to" method="get" action="{{.LoginPath}}">
+                <input class="button onboarding__button onboarding__button--full-width onboarding__button--secondary" type="submit" value="Sign in with a passkey" data-passkey-login="{{.PasskeyPath}}" data-redirect="{{.Redirect}}" />
+            </form>
+            {{end}}
+
+            {{if .Error}}
+            <p class="onboarding__error">{{.Error}}</p>
+            {{end}}
+            <p class="onboarding__error" data-passkey-error hidden></p>
+
+            {{if .LocalAuth}}
+            {{if .Providers}}
             <p class="onboarding__options-separator">
                 or sign in using email
             </p>
+            {{end}}
 
             <form class="simple_form onboarding__form" id="new_user" novalidate="novalidate" action="{{.LoginPath}}" accept-charset="UTF-8" method="post">
+                <input type="hidden" name="p" value="{{.Redirect}}" />
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
                 <div class="form-group hidden user_remember_me"><input class="form-control hidden" type="hidden" value="1" name="user[remember_me]" id="user_remember_me" /></div>
 
 
@@ -56,7 +75,7 @@
                         Email address
                     </label>
 
-                    <input class="string email required onboarding__input js-onboarding-email" id="signin-email-address" required="required" autofocus="autofocus" autocomplete="username" aria-required="true" placeholder="Email address" type="email" name="user[email]" />
+                    <input class="string email required onboarding__input js-onboarding-email" id="signin-email-address" required="required" autofocus="autofocus" autocomplete="username" aria-required="true" placeholder="Email address" type="email" name="username" />
                 </div>
 
                 <div class="onboarding__field onboarding__field--hide-label">
@@ -64,7 +83,7 @@
                         Password
                     </label>
 
-                    <input class="password required onboarding__input required" id="signin-password" required="required" autocomplete="current-password" aria-required="true" placeholder="Password" type="password" name="user[password]" />
+                    <input class="password required onboarding__input required" id="signin-password" required="required" autocomplete="current-password" aria-required="true" placeholder="Password" type="password" name="password" />
                 </div>
 
                 <div class="onboarding__actions">
@@ -76,9 +95,13 @@
             <p class="onboarding__footer">
                 <a href="/users/password/new">Forgot your password?</a>
             </p>
+            {{end}}
         </div>
     </main>
 </section>
 
+{{if .Passkeys}}
+<script src="{{.StaticPath}}/passkey.js"></script>
+{{end}}
 </body>
 </html>
@@ -0,0 +1,77 @@
+<!DOCTYPE html>
+<html lang="en" class="no-min-dimensions">
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+
+    <title>Passkeys</title>
+
+    <link rel="icon" type="image/x-icon" href="{{.StaticPath}}/favicon.png">
+
+    <link rel="apple-touch-icon" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="apple-touch-icon-precomposed" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="mask-icon" href="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF">
+
+    <meta charset="utf-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="apple-mobile-web-app-capable" content="yes">
+    <meta name="apple-mobile-web-app-status-bar-style" content="black">
+    <meta name="apple-mobile-web-app-title" content="Passkeys">
+
+    <link rel="preload" href="{{.StaticPath}}/fa-regular-400.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/fa-solid-900.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-Regular.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-SemiBold.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+
+    <link rel="stylesheet" media="screen" href="{{.StaticPath}}/application.css" />
+</head>
+<body class="no-min-dimensions">
+
+<section class="onboarding onboarding--centered">
+    <main class="onboarding__main">
+        <div class="onboarding__wrapper">
+
+            <header class="onboarding__header">
+                <div class="onboarding__logo">
+                    <img alt="" src="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF"/>
+                </div>
+
+                <h1 class="onboarding__title">Passkeys</h1>
+            </header>
+
+            <p class="onboarding__options-separator">
+                {{if .Passkeys}}
+                You have {{.Passkeys}} passkey{{if gt .Passkeys 1}}s{{end}}{{if .Email}} for {{.Email}}{{end}}.
+                {{else}}
+                Add a passkey to sign in{{if .Email}} as {{.Email}}{{end}} with your fingerprint, face or device PIN
+                instead of a password.
+                {{end}}
+            </p>
+
+            <p class="onboarding__error" data-passkey-error hidden></p>
+
+            {{if .Available}}
+            <form class="button_to" method="get" action="{{.PasskeyPath}}">
+                <input class="button onboarding__button onboarding__button--full-width" type="submit" value="Add a passkey" data-passkey-register="{{.PasskeyPath}}" />
+            </form>
+            {{else}}
+            <p class="onboarding__options-separator">
+                Passkeys are only available to users signing in with a username and password.
+            </p>
+            {{end}}
+            {{if .Passkeys}}
+            <form class="button_to" method="get" action="{{.PasskeyPath}}">
+                <input class="button onboarding__button onboarding__button--full-width onboarding__button--secondary" type="submit" value="Remove all passkeys" data-passkey-remove="{{.PasskeyPath}}" />
+            </form>
+            {{end}}
+
+            <p class="onboarding__footer">
+                <a href="/">Continue</a> &middot; <a href="{{.LogoutPath}}">Sign out</a>
+            </p>
+        </div>
+    </main>
+</section>
+
+<script src="{{.StaticPath}}/passkey.js"></script>
+</body>
+</html>
@@ -0,0 +1,65 @@
+<!DOCTYPE html>
+<html lang="en" class="no-min-dimensions">
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+
+    <title>Access pending</title>
+
+    <link rel="icon" type="image/x-icon" href="{{.StaticPath}}/favicon.png">
+
+    <link rel="apple-touch-icon" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="apple-touch-icon-precomposed" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="mask-icon" href="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF">
+
+    <meta charset="utf-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="apple-mobile-web-app-capable" content="yes">
+    <meta name="apple-mobile-web-app-status-bar-style" content="black">
+    <meta name="apple-mobile-web-app-title" content="Access pending">
+
+    <link rel="preload" href="{{.StaticPath}}/fa-regular-400.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/fa-solid-900.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-Regular.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-SemiBold.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+
+    <link rel="stylesheet" media="screen" href="{{.StaticPath}}/application.css" />
+</head>
+<body class="no-min-dimensions">
+
+<section class="onboarding onboarding--centered">
+    <main class="onboarding__main">
+        <div class="onboarding__wrapper">
+
+            <header class="onboarding__header">
+                <div class="onboarding__logo">
+                    <img alt="" src="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF"/>
+                </div>
+
+                {{if .Denied}}
+                <h1 class="onboarding__title">Access denied</h1>
+                {{else}}
+                <h1 class="onboarding__title">Access pending</h1>
+                {{end}}
+            </header>
+
+            {{if .Denied}}
+            <p class="onboarding__options-separator">
+                Your request for access as {{.Email}} has been denied by an administrator.
+            </p>
+            {{else}}
+            <p class="onboarding__options-separator">
+                Your request for access as {{.Email}} is waiting for approval by an administrator. Reload this page once
+                you have been approved.
+            </p>
+            {{end}}
+
+            <form class="button_to" method="get" action="{{.LogoutPath}}">
+                <input class="button onboarding__button onboarding__button--full-width onboarding__button--secondary" type="submit" value="Sign in as another user" />
+            </form>
+        </div>
+    </main>
+</section>
+
+</body>
+</html>
@@ -0,0 +1,112 @@
+<!DOCTYPE html>
+<html lang="en" class="no-min-dimensions">
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+
+    <title>Verification</title>
+
+    <link rel="icon" type="image/x-icon" href="{{.StaticPath}}/favicon.png">
+
+    <link rel="apple-touch-icon" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="apple-touch-icon-precomposed" href="{{.StaticPath}}/apple-touch-icon.png">
+    <link rel="mask-icon" href="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF">
+
+    <meta charset="utf-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="apple-mobile-web-app-capable" content="yes">
+    <meta name="apple-mobile-web-app-status-bar-style" content="black">
+    <meta name="apple-mobile-web-app-title" content="Verification">
+
+    <link rel="preload" href="{{.StaticPath}}/fa-regular-400.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/fa-solid-900.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-Regular.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+    <link rel="preload" href="{{.StaticPath}}/Inter-SemiBold.woff2" as="font" type="font/woff2" crossorigin="anonymous">
+
+    <link rel="stylesheet" media="screen" href="{{.StaticPath}}/application.css" />
+</head>
+<body class="no-min-dimensions">
+
+<section class="onboarding onboarding--centered">
+    <main class="onboarding__main">
+        <div class="onboarding__wrapper">
+
+            <header class="onboarding__header">
+                <div class="onboarding__logo">
+                    <img alt="" src="{{.StaticPath}}/ninja-portrait.svg" color="#6078FF"/>
+                </div>
+
+                {{if .RecoveryCodes}}
+                <h1 class="onboarding__title">Recovery codes</h1>
+                {{else if .Enrol}}
+                <h1 class="onboarding__title">Set up two-factor authentication</h1>
+                {{else}}
+                <h1 class="onboarding__title">Two-factor authentication</h1>
+                {{end}}
+            </header>
+
+            {{if .RecoveryCodes}}
+            <p class="onboarding__options-separator">
+                Keep these recovery codes somewhere safe. Each code can be used once instead of a code from your
+                authenticator app, if you lose access to it. They will not be shown again.
+            </p>
+
+            <ul>
+                {{range .RecoveryCodes}}
+                <li><code>{{.}}</code></li>
+                {{end}}
+            </ul>
+
+            <form class="button_to" method="get" action="{{.Redirect}}">
+                <input class="button onboarding__button onboarding__button--full-width" type="submit" value="Continue" />
+            </form>
+            {{else}}
+            {{if .Enrol}}
+            <p class="onboarding__options-separator">
+                Scan the QR code with an authenticator app, or enter the key below, then enter the code shown by the app.
+            </p>
+
+            <div class="onboarding__field">
+                <a href="{{.URI}}"><img alt="QR code of the authenticator key" src="{{.QRCode}}" width="256" height="256"/></a>
+            </div>
+            <p class="onboarding__options-separator">
+                <code>{{.Secret}}</code>
+            </p>
+            {{else}}
+            <p class="onboarding__options-separator">
+                Enter the code shown by your authenticator app, or one of your recovery codes.
+            </p>
+            {{end}}
+
+            {{if .Error}}
+            <p class="onboarding__error">{{.Error}}</p>
+            {{end}}
+
+            <form class="simple_form onboarding__form" novalidate="novalidate" action="{{.TOTPPath}}" accept-charset="UTF-8" method="post">
+                <input type="hidden" name="p" value="{{.Redirect}}" />
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+
+                <div class="onboarding__field onboarding__field--hide-label">
+                    <label class="onboarding__label" for="totp-code">
+                        Verification code
+                    </label>
+
+                    <input class="string required onboarding__input" id="totp-code" required="required" autofocus="autofocus" autocomplete="one-time-code" inputmode="numeric" aria-required="true" placeholder="Verification code" type="text" name="code" />
+                </div>
+
+                <div class="onboarding__actions">
+                    <button class="button onboarding__button onboarding__button--full-width">
+                        Verify
+                    </button>
+                </div>
+            </form>
+            <p class="onboarding__footer">
+                <a href="{{.LogoutPath}}">Sign in as another user</a>
+            </p>
+            {{end}}
+        </div>
+    </main>
+</section>
+
+</body>
+</html>
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/habakke/auth-proxy/internal/auth"
+	"github.com/habakke/auth-proxy/internal/session"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// totpURL returns the URL of the second factor page, which sends the user on to the redirect, showing the error
+// if it is set
+func (p *Proxy) totpURL(redirect string, code string) string {
+	v := url.Values{}
+	if redirect != "" && redirect != defaultRedirect {
+		v.Set("p", redirect)
+	}
+	if code != "" {
+		v.Set("error", code)
+	}
+	if len(v) == 0 {
+		return p.totpPath
+	}
+	return p.totpPath + "?" + v.Encode()
+}
+
+// pendingSecondFactor returns the session of a user of the login form who has entered the password, but not yet
+// the code from the authenticator app
+func (p *Proxy) pendingSecondFactor(req *http.Request) (*session.Data, bool) {
+	s, err := p.sessionManager.ReadSession(req)
+	if err != nil || !s.SecondFactorPending || !p.isLocalSession(s) {
+		return nil, false
+	}
+	return s, true
+}
+
+type totpPage struct {
+	Enrol         bool
+	Secret        string
+	URI           template.URL
+	QRCode        template.URL
+	RecoveryCodes []string
+	CSRFToken     string
+	Error         string
+	Redirect      string
+	TOTPPath      string
+	LogoutPath    string
+	StaticPath    string
+}
+
+func (p *Proxy) renderTOTPPage(res http.ResponseWriter, data totpPage) {
+	data.TOTPPath = p.totpPath
+	data.LogoutPath = p.logoutPath
+	data.StaticPath = p.staticPath
+
+	name := "totp.tpl"
+	_ = p.getTemplate(name).ExecuteTemplate(res, name, data)
+}
+
+// TOTPPage asks for the code from the authenticator app, and shows the QR code of a new secret to users who have
+// not enrolled yet
+func (p *Proxy) TOTPPage(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	redirect := p.redirectURL(req, req.URL.Query().Get("p"))
+	s, ok := p.pendingSecondFactor(req)
+	if !ok {
+		http.Redirect(res, req, p.loginURL(redirect), http.StatusFound)
+		return
+	}
+
+	e, err := p.totp.Enrolment(auth.TOTPUserKey(s.Provider, s.ID))
+	if err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to read totp enrolment")
+		errorHandler(res, req, "failed to read second factor")
+		return
+	}
+	csrfToken, err := p.sessionManager.AttachCSRFToken(res)
+	if err != nil {
+		log.Error().AnErr("err", err).Msg("failed to create csrf token")
+		errorHandler(res, req, "failed to create login form")
+		return
+	}
+
+	data := totpPage{
+		Enrol:     !e.Confirmed,
+		CSRFToken: csrfToken,
+		Error:     loginErrors[req.URL.Query().Get("error")],
+		Redirect:  redirect,
+	}
+	if data.Enrol {
+		data.Secret = e.Secret
+		uri := auth.TOTPURI(p.totp.Issuer(), s.ID, e.Secret)
+		data.URI = template.URL(uri) //#nosec
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			log.Error().AnErr("err", err).Msg("failed to create totp qr code")
+			errorHandler(res, req, "failed to create second factor")
+			return
+		}
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)) //#nosec
+	}
+	p.renderTOTPPage(res, data)
+}
+
+// VerifyTOTP checks the code from the authenticator app, or a recovery code, and marks the session authenticated.
+// The first code confirms the enrolment, after which the recovery codes are shown once.
+func (p *Proxy) VerifyTOTP(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	redirect := p.redirectURL(req, req.FormValue("p"))
+	s, ok := p.pendingSecondFactor(req)
+	if !ok {
+		http.Redirect(res, req, p.loginErrorURL(redirect, loginErrorExpired), http.StatusSeeOther)
+		return
+	}
+	if !p.sessionManager.VerifyCSRFToken(req, req.FormValue("csrf_token")) {
+		log.Info().Msg("second factor rejected, invalid csrf token")
+		http.Redirect(res, req, p.totpURL(redirect, loginErrorExpired), http.StatusSeeOther)
+		return
+	}
+
+	key := auth.TOTPUserKey(s.Provider, s.ID)
+	e, err := p.totp.Enrolment(key)
+	if err != nil {
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to read totp enrolment")
+		errorHandler(res, req, "failed to read second factor")
+		return
+	}
+
+	var recoveryCodes []string
+	code := req.FormValue("code")
+	if e.Confirmed {
+		ok, err = p.totp.Verify(key, code)
+	} else {
+		recoveryCodes, ok, err = p.totp.Confirm(key, code)
+	}
+	switch {
+	case errors.Is(err, auth.ErrSecondFactorLocked):
+		log.Info().Str("id", s.ID).Msg("second factor rejected, too many invalid codes")
+		http.Redirect(res, req, p.totpURL(redirect, loginErrorLocked), http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Error().AnErr("err", err).Str("id", s.ID).Msg("failed to verify totp code")
+		errorHandler(res, req, "failed to verify second factor")
+		return
+	case !ok:
+		log.Info().Str("id", s.ID).Msg("second factor rejected, invalid code")
+		http.Redirect(res, req, p.totpURL(redirect, loginErrorCode), http.StatusSeeOther)
+		return
+	}
+
+	// the pending session was issued before the user was authenticated, so it gets a new ID
+	s.SecondFactorPending = false
+	if err := p.sessionManager.RenewSession(res, req, *s); err != nil {
+		log.Error().AnErr("err", err).Msg("failed to attach session")
+		errorHandler(res, req, "failed to create session")
+		return
+	}
+	p.sessionManager.RemoveCSRFToken(res)
+
+	if recoveryCodes != nil {
+		log.Info().Str("id", s.ID).Msg("totp enrolled")
+		p.renderTOTPPage(res, totpPage{RecoveryCodes: recoveryCodes, Redirect: redirect})
+		return
+	}
+	http.Redirect(res, req, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+)
+
+// SetVerifyRedirect makes the verify endpoint redirect unauthenticated users to the login page instead of
+// answering 401. nginx auth_request only accepts 2xx, 401 and 403, so this is for Traefik and Caddy.
+func (p *Proxy) SetVerifyRedirect(redirect bool) {
+	p.verifyRedirect = redirect
+}
+
+// forwardedRequest returns a copy of the forward authentication request, with the method, host and URL of
+// the original request as reported by the ingress in X-Original-URL (nginx) or X-Forwarded-Uri (Traefik, Caddy)
+func forwardedRequest(req *http.Request) *http.Request {
+	orig := req.Clone(req.Context())
+	if method := req.Header.Get("X-Forwarded-Method"); method != "" {
+		orig.Method = method
+	}
+
+	var u *url.URL
+	var err error
+	if v := req.Header.Get("X-Original-URL"); v != "" {
+		u, err = url.Parse(v)
+	} else if v := req.Header.Get("X-Forwarded-Uri"); v != "" {
+		u, err = url.ParseRequestURI(v)
+	} else {
+		return orig
+	}
+	if err != nil {
+		log.Debug().AnErr("err", err).Msg("failed to parse forwarded uri")
+		return orig
+	}
+
+	if u.Host == "" {
+		u.Host = req.Header.Get("X-Forwarded-Host")
+	}
+	if u.Scheme == "" && u.Host != "" {
+		u.Scheme = req.Header.Get("X-Forwarded-Proto")
+		if u.Scheme == "" {
+			u.Scheme = "https"
+		}
+	}
+	if u.Host != "" {
+		orig.Host = u.Host
+	}
+	orig.URL = u
+	orig.RequestURI = u.RequestURI()
+	return orig
+}
+
+// Verify answers forward authentication requests from Traefik ForwardAuth, nginx auth_request or Caddy
+// forward_auth. It returns 200 with the identity of the user in the response headers when the policy allows
+// the request, 401 when it requires a login and 403 when it is denied.
+func (p *Proxy) Verify(res http.ResponseWriter, req *http.Request) {
+	disableCaching(res)
+
+	orig := forwardedRequest(req)
+	s, d := p.authorize(orig)
+	switch d {
+	case decisionAllow:
+		if err := p.sessionManager.RefreshSession(res, req, s); err != nil {
+			log.Error().AnErr("err", err).Msg("failed to refresh session")
+		}
+		if s != nil {
+			verifyIdentityHeaders.Set(res.Header(), s)
+			if err := p.setIdentityAssertion(res.Header(), s); err != nil {
+				log.Error().AnErr("err", err).Msg("failed to sign identity assertion")
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		res.WriteHeader(http.StatusOK)
+	case decisionLogin:
+		if p.verifyRedirect {
+			http.Redirect(res, req, p.loginURL(orig.URL.String()), http.StatusFound)
+			return
+		}
+		res.WriteHeader(http.StatusUnauthorized)
+	case decisionPending:
+		if p.verifyRedirect {
+			http.Redirect(res, req, p.pendingPath, http.StatusFound)
+			return
+		}
+		res.WriteHeader(http.StatusForbidden)
+	default:
+		res.WriteHeader(http.StatusForbidden)
+	}
+}
@@ -0,0 +1,188 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator is a software WebAuthn authenticator with discoverable P-256 credentials and no attestation, which
+// answers the options of the registration and login ceremonies like navigator.credentials in a browser
+type Authenticator struct {
+	Origin      string
+	credentials []*softCredential
+}
+
+type softCredential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns an authenticator sending the origin in the client data, as browsers do
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// Clone returns an authenticator with copies of the credentials, as if the private keys were stolen
+func (a *Authenticator) Clone() *Authenticator {
+	c := &Authenticator{Origin: a.Origin}
+	for _, cred := range a.credentials {
+		copied := *cred
+		c.credentials = append(c.credentials, &copied)
+	}
+	return c
+}
+
+type creationOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+type assertionOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+	} `json:"publicKey"`
+}
+
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Alg int    `cbor:"3,keyasint"`
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint"`
+}
+
+type attestationObject struct {
+	Fmt      string                 `cbor:"fmt"`
+	AttStmt  map[string]interface{} `cbor:"attStmt"`
+	AuthData []byte                 `cbor:"authData"`
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.Origin,
+	})
+	return data
+}
+
+func authData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, signCount)
+}
+
+// Create answers the JSON options of the registration ceremony with the JSON of a new credential
+func (a *Authenticator) Create(options []byte) ([]byte, error) {
+	o := creationOptions{}
+	if err := json.Unmarshal(options, &o); err != nil {
+		return nil, err
+	}
+	userHandle, err := b64.DecodeString(o.PublicKey.User.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user handle: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cred := &softCredential{id: make([]byte, 16), rpID: o.PublicKey.RP.ID, userHandle: userHandle, key: key}
+	if _, err = rand.Read(cred.id); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := cbor.Marshal(coseKey{Kty: 2, Alg: -7, Crv: 1, X: key.X.FillBytes(make([]byte, 32)), Y: key.Y.FillBytes(make([]byte, 32))})
+	if err != nil {
+		return nil, err
+	}
+	data := authData(cred.rpID, flagUserPresent|flagUserVerified|flagAttestedData, 0)
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(cred.id)))
+	data = append(data, cred.id...)
+	data = append(data, publicKey...)
+
+	attestation, err := cbor.Marshal(attestationObject{Fmt: "none", AttStmt: map[string]interface{}{}, AuthData: data})
+	if err != nil {
+		return nil, err
+	}
+	a.credentials = append(a.credentials, cred)
+
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(cred.id),
+		"rawId": b64.EncodeToString(cred.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", o.PublicKey.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	})
+}
+
+// Get answers the JSON options of the login ceremony with the JSON of an assertion of the first credential of the
+// relying party
+func (a *Authenticator) Get(options []byte) ([]byte, error) {
+	o := assertionOptions{}
+	if err := json.Unmarshal(options, &o); err != nil {
+		return nil, err
+	}
+
+	var cred *softCredential
+	for _, c := range a.credentials {
+		if c.rpID == o.PublicKey.RPID {
+			cred = c
+			break
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no credential for relying party %q", o.PublicKey.RPID)
+	}
+
+	cred.signCount++
+	data := authData(cred.rpID, flagUserPresent|flagUserVerified, cred.signCount)
+	clientData := a.clientData("webauthn.get", o.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), data...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(cred.id),
+		"rawId": b64.EncodeToString(cred.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(data),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(cred.userHandle),
+		},
+	})
+}